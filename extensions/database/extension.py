@@ -0,0 +1,172 @@
+# Licensed to the Apache Software Foundation (ASF) under one or more
+# contributor license agreements.  See the NOTICE file distributed with
+# this work for additional information regarding copyright ownership.
+# The ASF licenses this file to You under the Apache License, Version 2.0
+# (the "License"); you may not use this file except in compliance with
+# the License.  You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Database Extension
+
+Enables the PDO driver for bound MySQL and PostgreSQL services
+
+Bind a MySQL or PostgreSQL service to the app and `pdo_mysql` or `pdo_pgsql`
+is loaded.  With `DATABASE_ENV`, the service's credentials are also exported
+as `DATABASE_URL` and the `DB_*` variables Laravel and others read.  When
+more than one database is bound, set `DATABASE_SERVICE_NAME` to the name of
+the one to export.  The credentials are read from $VCAP_SERVICES when the
+app starts, so rotated credentials only need a restart, but the database is
+picked when the app is staged, so restage after binding a different one.
+"""
+import os
+import logging
+from urlparse import urlparse
+from compile_helpers import _is_enabled
+from extension_helpers import ExtensionHelper
+
+_log = logging.getLogger('database')
+
+
+# kind of database: (PDO extension, DB_CONNECTION, URL schemes, names)
+DATABASES = {
+    'mysql': ('pdo_mysql', 'mysql', ('mysql', 'mysql2'),
+              ('mysql', 'mariadb', 'cleardb')),
+    'postgres': ('pdo_pgsql', 'pgsql', ('postgres', 'postgresql'),
+                 ('postgres', 'elephantsql'))
+}
+
+
+def database_kind(service):
+    """Returns `mysql` or `postgres` for a bound database, or None"""
+    creds = service.get('credentials', {}) or {}
+    scheme = urlparse(str(creds.get('uri', ''))).scheme.lower()
+    for kind, (ext, conn, schemes, names) in DATABASES.iteritems():
+        if scheme in schemes:
+            return kind
+    labels = [str(service.get('label', '')).lower()]
+    labels.extend(str(tag).lower() for tag in service.get('tags', []) or [])
+    for kind, (ext, conn, schemes, names) in DATABASES.iteritems():
+        if any(name in label for name in names for label in labels):
+            return kind
+    return None
+
+
+def _shell_quote(val):
+    return "'%s'" % str(val).replace("'", "'\\''")
+
+
+# run from .profile.d, so the credentials aren't copied into the droplet
+DATABASE_PROFILE_SCRIPT = r"""# Exports the credentials of a bound database from $VCAP_SERVICES
+eval "$(python - {name} {connection} <<'EOF'
+import json
+import os
+import sys
+try:
+    from urllib.parse import urlparse
+except ImportError:
+    from urlparse import urlparse
+
+name, connection = sys.argv[1:3]
+vcap_services = json.loads(os.environ.get('VCAP_SERVICES') or 'null')
+for services in (vcap_services or dict()).values():
+    for service in services:
+        if service.get('name') != name:
+            continue
+        creds = service.get('credentials') or dict()
+        uri = urlparse(str(creds.get('uri', '')))
+        env = [
+            ('DB_CONNECTION', connection),
+            ('DB_HOST', creds.get('hostname') or creds.get('host') or
+                uri.hostname),
+            ('DB_PORT', creds.get('port') or uri.port),
+            ('DB_DATABASE', creds.get('name') or creds.get('database') or
+                uri.path.lstrip('/')),
+            ('DB_USERNAME', creds.get('username') or creds.get('user') or
+                uri.username),
+            ('DB_PASSWORD', creds.get('password') or uri.password),
+            ('DATABASE_URL', creds.get('uri'))
+        ]
+        for key, val in env:
+            if not val:
+                continue
+            val = (u'%s' % val).replace(u"'", u"'\\''")
+            line = u"export %s='%s'\n" % (key, val)
+            if sys.version_info[0] < 3:
+                line = line.encode('utf-8')
+            sys.stdout.write(line)
+        sys.exit(0)
+sys.stderr.write('WARNING: The database [' + name + '] is not bound, '
+                 'DATABASE_URL and DB_* are not set.\n')
+EOF
+)"
+"""
+
+
+class DatabaseExtension(ExtensionHelper):
+    def __init__(self, ctx):
+        ExtensionHelper.__init__(self, ctx)
+        self._databases = None
+
+    def databases(self):
+        """Returns a list of (kind, service) for the bound databases"""
+        if self._databases is None:
+            self._databases = []
+            for provider, services in sorted(self._services.iteritems()):
+                for service in services:
+                    kind = database_kind(service)
+                    if kind:
+                        self._databases.append((kind, service))
+        return self._databases
+
+    def _should_compile(self):
+        return len(self.databases()) > 0
+
+    def _configure(self):
+        exts = self._ctx.setdefault('PHP_EXTENSIONS', [])
+        for kind, service in self.databases():
+            ext = DATABASES[kind][0]
+            if ext not in exts:
+                _log.info('Loading [%s] for the bound service [%s]',
+                          ext, service.get('name'))
+                exts.append(ext)
+
+    def _env_service(self):
+        """Returns the (kind, service) whose credentials are exported"""
+        databases = self.databases()
+        name = self._ctx.get('DATABASE_SERVICE_NAME')
+        if name:
+            for kind, service in databases:
+                if service.get('name') == name:
+                    return (kind, service)
+            raise RuntimeError('DATABASE_SERVICE_NAME is [%s], but no bound '
+                               'database has that name' % name)
+        if len(databases) > 1:
+            raise RuntimeError(
+                'More than one database is bound (%s), set '
+                'DATABASE_SERVICE_NAME to the one to use' %
+                ', '.join(service.get('name', '') for kind, service
+                          in databases))
+        return databases[0]
+
+    def _compile(self, install):
+        if not _is_enabled(self._ctx.get('DATABASE_ENV', False)):
+            return
+        (kind, service) = self._env_service()
+        profile_d = os.path.join(self._ctx['BUILD_DIR'], '.profile.d')
+        if not os.path.exists(profile_d):
+            os.makedirs(profile_d)
+        with open(os.path.join(profile_d, 'bp_database.sh'), 'w') as f:
+            f.write(DATABASE_PROFILE_SCRIPT.format(
+                name=_shell_quote(service.get('name', '')),
+                connection=DATABASES[kind][1]))
+        _log.info('Credentials of [%s] will be read at startup',
+                  service.get('name'))
+
+
+DatabaseExtension.register(__name__)
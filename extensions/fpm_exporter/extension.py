@@ -0,0 +1,109 @@
+# Licensed to the Apache Software Foundation (ASF) under one or more
+# contributor license agreements.  See the NOTICE file distributed with
+# this work for additional information regarding copyright ownership.
+# The ASF licenses this file to You under the Apache License, Version 2.0
+# (the "License"); you may not use this file except in compliance with
+# the License.  You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""FPM Metrics Exporter Extension
+
+Runs a Prometheus exporter for the PHP-FPM status page next to php-fpm.
+
+Enable `PHP_FPM_STATUS` and `FPM_METRICS_EXPORTER` in `.bp-config/options.json`
+and the extension installs the `php-fpm-exporter` dependency from the
+manifest and adds it to the release YAML as a sidecar of the web process.
+Staging fails when the buildpack's manifest has no `php-fpm-exporter`.
+
+The exporter listens on `FPM_METRICS_EXPORTER_PORT`, 9253 by default.  The
+router only sends traffic to $PORT, so the metrics aren't reachable through
+the app's public route.  Scrape them over container networking instead: map
+an internal route, like `myapp.apps.internal`, allow Prometheus to reach the
+port with
+
+    cf add-network-policy prometheus myapp --port 9253 --protocol tcp
+
+and scrape `http://myapp.apps.internal:9253/metrics`.  With more than one
+instance, use the DNS name of each, like `0.myapp.apps.internal`.
+"""
+import os
+from extension_helpers import ExtensionHelper
+from compile_helpers import load_manifest
+from compile_helpers import fpm_status_path
+from compile_helpers import is_web_app
+from compile_helpers import _is_enabled
+
+
+class FpmExporterExtension(ExtensionHelper):
+    DEPENDENCY = 'php-fpm-exporter'
+
+    def _defaults(self):
+        return {
+            'FPM_METRICS_EXPORTER_PORT': 9253,
+            'PHP_FPM_EXPORTER_DOWNLOAD_URL':
+                '/php-fpm-exporter/{PHP_FPM_EXPORTER_VERSION}/'
+                'php-fpm-exporter-{PHP_FPM_EXPORTER_VERSION}.tar.gz',
+            'PHP_FPM_EXPORTER_PACKAGE_INSTALL_DIR': 'php-fpm-exporter',
+            'PHP_FPM_EXPORTER_STRIP': False
+        }
+
+    def _manifest_version(self):
+        for dep in load_manifest(self._ctx).get('dependencies', []):
+            if dep.get('name') == self.DEPENDENCY:
+                return dep['version']
+        return None
+
+    def _installed(self):
+        return os.path.exists(os.path.join(
+            self._ctx['BUILD_DIR'], 'php-fpm-exporter', 'php-fpm_exporter'))
+
+    def _scrape_uri(self):
+        listen = self._ctx.get('PHP_FPM_LISTEN', '127.0.0.1:9000')
+        if listen.startswith('/'):
+            return 'unix://%s;%s' % (listen, fpm_status_path(self._ctx))
+        return 'tcp://%s%s' % (listen, fpm_status_path(self._ctx))
+
+    def _should_compile(self):
+        return (_is_enabled(self._ctx.get('FPM_METRICS_EXPORTER', False)) and
+                is_web_app(self._ctx))
+
+    def _configure(self):
+        version = self._manifest_version()
+        if not version:
+            raise RuntimeError('FPM_METRICS_EXPORTER is set, but this '
+                               'buildpack does not provide %s. Unset '
+                               'FPM_METRICS_EXPORTER, or use a buildpack '
+                               'which includes it.' % self.DEPENDENCY)
+        self._ctx['PHP_FPM_EXPORTER_VERSION'] = version
+
+    def _compile(self, install):
+        if not fpm_status_path(self._ctx):
+            print('WARNING: FPM_METRICS_EXPORTER requires PHP_FPM_STATUS '
+                  'and will be ignored.')
+            return
+        version = self._ctx['PHP_FPM_EXPORTER_VERSION']
+        print 'Installing FPM metrics exporter %s' % version
+        (install
+            .package('PHP_FPM_EXPORTER')
+            .done())
+
+    def _sidecar_commands(self):
+        if not self._installed():
+            return {}
+        return {
+            'fpm-exporter': (
+                '$HOME/php-fpm-exporter/php-fpm_exporter',
+                'server',
+                '--phpfpm.scrape-uri "%s"' % self._scrape_uri(),
+                '--web.listen-address ":%s"' %
+                self._ctx['FPM_METRICS_EXPORTER_PORT'])
+        }
+
+
+FpmExporterExtension.register(__name__)
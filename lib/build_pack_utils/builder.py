@@ -2,6 +2,7 @@ import os
 import sys
 import shutil
 import re
+import json
 import logging
 from collections import defaultdict
 from StringIO import StringIO
@@ -23,8 +24,14 @@ from detecter import EndsWithFileSearch
 from detecter import ContainsFileSearch
 from runner import BuildPack
 from utils import rewrite_cfgs
+from utils import apply_umask
+from utils import umask_mode
+from utils import is_valid_umask
+from utils import release_task_errors
 from utils import process_extension
 from utils import process_extensions
+from utils import load_processes
+from utils import safe_makedirs
 
 
 _log = logging.getLogger('builder')
@@ -74,6 +81,39 @@ class Configurer(object):
         if web_server != 'none' and web_server != 'nginx' and web_server != 'httpd':
             sys.stderr.write("{0} isn't a supported web server. Supported web servers are 'httpd' & 'nginx'\n".format(web_server))
             sys.exit(1)
+        file_umask = self.builder._ctx.get('FILE_UMASK')
+        if file_umask is not None and not is_valid_umask(file_umask):
+            sys.stderr.write("{0} isn't a valid FILE_UMASK. It must be an octal umask like '022' or '027'\n".format(file_umask))
+            sys.exit(1)
+        drain_timeout = self.builder._ctx.get('SHUTDOWN_DRAIN_TIMEOUT')
+        if drain_timeout is not None and \
+                not re.match(r'^\d+$', str(drain_timeout)):
+            sys.stderr.write("{0} isn't a valid SHUTDOWN_DRAIN_TIMEOUT. It must be a number of seconds\n".format(drain_timeout))
+            sys.exit(1)
+        size_warn = self.builder._ctx.get('DROPLET_SIZE_WARN_MB')
+        if size_warn is not None and \
+                not re.match(r'^\d+(\.\d+)?$', str(size_warn)):
+            sys.stderr.write("{0} isn't a valid DROPLET_SIZE_WARN_MB. It must be a number of megabytes\n".format(size_warn))
+            sys.exit(1)
+        start_cmd = self.builder._ctx.get('CUSTOM_START_COMMAND')
+        if start_cmd:
+            start_path = os.path.normpath(
+                os.path.join(self.builder._ctx['BUILD_DIR'], start_cmd))
+            if os.path.isabs(start_cmd) or start_cmd.startswith('..') or \
+                    re.search(r'\s', start_cmd):
+                sys.stderr.write("{0} isn't a valid CUSTOM_START_COMMAND. It must be the path of a script in your application\n".format(start_cmd))
+                sys.exit(1)
+            if not os.path.isfile(start_path) or \
+                    not os.access(start_path, os.X_OK):
+                sys.stderr.write("CUSTOM_START_COMMAND {0} must be an executable file in your application\n".format(start_cmd))
+                sys.exit(1)
+        release_tasks = self.builder._ctx.get('RELEASE_TASKS')
+        if release_tasks is not None:
+            errors = release_task_errors(release_tasks)
+            if errors:
+                for error in errors:
+                    sys.stderr.write("%s\n" % error)
+                sys.exit(1)
         return self
 
     def done(self):
@@ -380,6 +420,33 @@ class ConfigInstaller(object):
         self._delimiter = delimiter
         return self
 
+    def _report_overrides(self):
+        """Log which of the application's config files replace a
+        config file from the build pack and which are new"""
+        appPath = os.path.join(self._ctx['BUILD_DIR'], self._app_path)
+        toPath = os.path.join(self._ctx['BUILD_DIR'], self._to_path)
+        if os.path.isfile(appPath):
+            files = [os.path.basename(appPath)]
+            appPath = os.path.dirname(appPath)
+        else:
+            files = []
+            for root, dirs, names in os.walk(appPath):
+                for name in names:
+                    files.append(os.path.relpath(
+                        os.path.join(root, name), appPath))
+        for name in sorted(files):
+            if os.path.exists(os.path.join(toPath, name)):
+                _log.info('User config [%s] overrides the default [%s]',
+                          os.path.join(self._app_path, name),
+                          os.path.join(self._to_path, name))
+                print '-----> Using [%s] in place of the default config' % \
+                    os.path.join(self._app_path, name)
+            else:
+                _log.info('User config [%s] added to [%s]',
+                          os.path.join(self._app_path, name), self._to_path)
+                print '-----> Adding config [%s]' % \
+                    os.path.join(self._app_path, name)
+
     def _rewrite_cfgs(self):
         rewrite_cfgs(os.path.join(self._ctx['BUILD_DIR'], self._to_path),
                      self._ctx,
@@ -391,10 +458,14 @@ class ConfigInstaller(object):
                 self._cfInst.install_from_build_pack(self._bp_path,
                                                      self._to_path)
             if self._app_path:
+                self._report_overrides()
                 self._cfInst.install_from_application(self._app_path,
                                                       self._to_path)
         if self._delimiter:
             self._rewrite_cfgs()
+        if self._to_path:
+            apply_umask(self._ctx,
+                        os.path.join(self._ctx['BUILD_DIR'], self._to_path))
         return self._installer
 
 
@@ -696,7 +767,7 @@ class StartScriptBuilder(object):
         with open(startScriptPath, 'wt') as out:
             if self.content:
                 out.write('\n'.join(self.content))
-        os.chmod(startScriptPath, 0755)
+        os.chmod(startScriptPath, umask_mode(self.builder._ctx, 0755))
         return self.builder
 
 
@@ -854,6 +925,10 @@ class SaveBuilder(object):
                 else:
                     all_extns_env[key].append(val)
         process_extensions(self._builder._ctx, 'service_environment', process)
+        # read by the process manager, when the app is stopped
+        if 'SHUTDOWN_DRAIN_TIMEOUT' in self._builder._ctx:
+            all_extns_env['SHUTDOWN_DRAIN_TIMEOUT'].append(
+                str(self._builder._ctx['SHUTDOWN_DRAIN_TIMEOUT']))
         # Write pool of environment items to disk, a single item is
         #  written in 'key=val' format, while lists are written as
         #  'key=val:val:val' where ':' is os.pathsep.
@@ -871,6 +946,7 @@ class SaveBuilder(object):
                 elif len(val) > 1:
                     val = os.pathsep.join(val)
                 envFile.write("export %s=%s\n" % (key, val))
+        apply_umask(self._builder._ctx, envPath)
         return self
 
     def process_list(self):
@@ -882,6 +958,20 @@ class SaveBuilder(object):
         process_extensions(self._builder._ctx, 'service_commands', process)
         return self
 
+    def sidecar_list(self):
+        # read by release, which puts these in the release YAML
+        def process(cmds):
+            if not cmds:
+                return
+            sidecarPath = os.path.join(self._builder._ctx['BUILD_DIR'],
+                                       '.bp', 'sidecars')
+            safe_makedirs(os.path.dirname(sidecarPath))
+            with open(sidecarPath, 'at') as sidecarFile:
+                for name, cmd in cmds.iteritems():
+                    sidecarFile.write("%s: %s\n" % (name, ' '.join(cmd)))
+        process_extensions(self._builder._ctx, 'sidecar_commands', process)
+        return self
+
     def done(self):
         return self._builder
 
@@ -973,5 +1063,20 @@ class Builder(object):
 
     def release(self):
         print 'default_process_types:'
-        print '  web: $HOME/%s' % self._ctx.get('START_SCRIPT_NAME',
-                                                '.bp/bin/start')
+        # the .profile.d scripts, which rewrite the configs, run first
+        #  either way, so a custom command can still use .bp/bin/start
+        print '  web: $HOME/%s' % (
+            self._ctx.get('CUSTOM_START_COMMAND') or
+            self._ctx.get('START_SCRIPT_NAME', '.bp/bin/start'))
+        # one-off tasks, like migrations, are extra process types which
+        #  aren't routed and are run with `cf run-task`
+        for name, cmd in sorted(self._ctx.get('RELEASE_TASKS', {}).items()):
+            print '  %s: %s' % (name, json.dumps(cmd))
+        # sidecars run in the web process' container, next to the server
+        sidecarPath = os.path.join(self._ctx['BUILD_DIR'], '.bp', 'sidecars')
+        if os.path.exists(sidecarPath):
+            print 'sidecars:'
+            for name, cmd in sorted(load_processes(sidecarPath).items()):
+                print '- name: %s' % name
+                print '  process_types: [web]'
+                print '  command: %s' % json.dumps(cmd)
@@ -1,10 +1,14 @@
 import os
+import re
 import sys
 import json
 import tempfile
 import shutil
+import hashlib
 import utils
 import logging
+import threading
+import yaml
 from compile_extensions import CompileExtensions
 from urlparse import urlparse
 from zips import UnzipUtil
@@ -102,6 +106,15 @@ class CloudFoundryUtil(object):
             safe_makedirs(logDir)
             logging.basicConfig(level=logLevel, format=logFmt,
                                 filename=os.path.join(logDir, 'bp.log'))
+        # BP_LOG_FILE gets a copy of everything logged, without changing
+        #  where the log is written otherwise
+        logFile = ctx.get('BP_LOG_FILE')
+        if logFile:
+            logFile = os.path.join(ctx['BUILD_DIR'], logFile)
+            safe_makedirs(os.path.dirname(logFile))
+            handler = logging.FileHandler(logFile)
+            handler.setFormatter(logging.Formatter(logFmt))
+            logging.getLogger().addHandler(handler)
 
     @staticmethod
     def load_json_config_file_from(folder, cfgFile, step=None):
@@ -183,15 +196,129 @@ class CloudFoundryInstaller(object):
             shutil.copy(fileToInstall, installDir)
             return installDir
 
+    def install_binary_verified(self, url, sha256, installDir, strip=False):
+        """Install a binary from outside the manifest, checking its SHA256"""
+        fileName = urlparse(url).path.split('/')[-1]
+        fileToInstall = os.path.join(self._ctx['TMPDIR'], fileName)
+
+        self._log.debug("Installing verified [%s]", url)
+        self._dwn.custom_extension_download(url, url, fileToInstall)
+
+        digest = hashlib.sha256()
+        with open(fileToInstall, 'rb') as f:
+            for chunk in iter(lambda: f.read(65536), b''):
+                digest.update(chunk)
+        if digest.hexdigest() != sha256.lower():
+            self._log.error("SHA256 of [%s] is [%s], expected [%s]",
+                            url, digest.hexdigest(), sha256)
+            raise RuntimeError("Checksum of downloaded dependency does not "
+                               "match expected value")
+        return self._unzipUtil.extract(fileToInstall, installDir, strip)
+
+    def _cache_path(self, url):
+        if not self._ctx.get('CACHE_DIR'):
+            return None
+        return os.path.join(self._ctx['CACHE_DIR'], 'dependencies',
+                            urlparse(url).path.lstrip('/'))
+
+    def fetch_to_cache(self, url):
+        """Download a dependency into the cache, unless it's there already
+
+        Returns the path of the cached file or None, when there's no cache.
+        """
+        cachePath = self._cache_path(url)
+        if cachePath is None or os.path.exists(cachePath):
+            return cachePath
+        fileName = urlparse(url).path.split('/')[-1]
+        tmpDir = tempfile.mkdtemp(dir=self._ctx['TMPDIR'])
+        try:
+            self._dwn.download(url, tmpDir)
+            safe_makedirs(os.path.dirname(cachePath))
+            shutil.move(os.path.join(tmpDir, fileName), cachePath)
+        finally:
+            shutil.rmtree(tmpDir, ignore_errors=True)
+        self._log.debug("Cached [%s] at [%s]", url, cachePath)
+        return cachePath
+
+    def warm_cache(self, urls):
+        """Download dependencies into the cache in parallel
+
+        Failures are only logged, the install of the dependency will
+        try again and report the error.
+        """
+        def fetch(url):
+            try:
+                self.fetch_to_cache(url)
+            except Exception:
+                self._log.warning("Could not warm the cache for [%s]", url,
+                                  exc_info=True)
+        threads = [threading.Thread(target=fetch, args=(url,))
+                   for url in urls]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+
+    def _manifest_sha256(self, url):
+        """Returns the SHA256 the manifest lists for a dependency url
+
+        The url is mapped to a dependency with url_to_dependency_map, like
+        compile-extensions does.  None when there's no such dependency.
+        """
+        manifestFile = os.path.join(self._ctx['BP_DIR'], 'manifest.yml')
+        if not os.path.exists(manifestFile):
+            return None
+        with open(manifestFile) as f:
+            manifest = yaml.safe_load(f)
+        for mapping in manifest.get('url_to_dependency_map', []):
+            m = re.search(mapping['match'], url)
+            if m:
+                # the map refers to groups as $1
+                (name, version) = [m.expand(re.sub(r'\$(\d+)', r'\\\1',
+                                                   str(mapping[key])))
+                                   for key in ('name', 'version')]
+                break
+        else:
+            return None
+        stack = os.environ.get('CF_STACK')
+        for dep in manifest.get('dependencies', []):
+            if dep['name'] == name and str(dep['version']) == version and \
+                    (not stack or stack in dep.get('cf_stacks', [stack])):
+                return dep.get('sha256')
+        return None
+
+    def _cached_file_is_valid(self, url, cachePath):
+        digest = hashlib.sha256()
+        with open(cachePath, 'rb') as f:
+            for chunk in iter(lambda: f.read(65536), b''):
+                digest.update(chunk)
+        sha256 = self._manifest_sha256(url)
+        return sha256 is not None and digest.hexdigest() == sha256.lower()
+
     def _install_binary_from_manifest(self, url, installDir,
             strip=False,
             extract=True):
         self._log.debug("Installing binary from manifest [%s]", url)
-        self._dwn.download(url, self._ctx['TMPDIR'])
-
         fileName = urlparse(url).path.split('/')[-1]
         fileToInstall = os.path.join(self._ctx['TMPDIR'], fileName)
 
+        cachePath = self._cache_path(url)
+        # the cache outlives builds, so a truncated or changed file would
+        #  otherwise be used from then on
+        if cachePath and os.path.exists(cachePath) and \
+                not self._cached_file_is_valid(url, cachePath):
+            self._log.warning("Cached [%s] doesn't match the manifest's "
+                              "SHA256, downloading it again", cachePath)
+            os.remove(cachePath)
+        if cachePath and os.path.exists(cachePath):
+            self._log.debug("Using cached [%s]", cachePath)
+            shutil.copy(cachePath, fileToInstall)
+            _, patch_warning = CompileExtensions(
+                self._ctx['BP_DIR']).warn_if_newer_patch(url)
+            print patch_warning
+        else:
+            self._dwn.download(url, self._ctx['TMPDIR'])
+
         if extract:
             return self._unzipUtil.extract(fileToInstall,
                     installDir,
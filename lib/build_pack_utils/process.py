@@ -1,5 +1,6 @@
 from __future__ import print_function
 
+import os
 import signal
 import subprocess
 import sys
@@ -56,9 +57,11 @@ def _enqueue_output(proc, queue):
 
 
 class Process(subprocess.Popen):
-    def __init__(self, cmd, name=None, quiet=False, *args, **kwargs):
+    def __init__(self, cmd, name=None, quiet=False, stop_signal=None,
+                 *args, **kwargs):
         self.name = name
         self.quiet = quiet
+        self.stop_signal = stop_signal or signal.SIGTERM
         self.reader = None
         self.printer = None
         self.dead = False
@@ -66,17 +69,39 @@ class Process(subprocess.Popen):
         if self.quiet:
             self.name = "{0} (quiet)".format(self.name)
 
+        # cmd runs in its own session, so its process group holds the shell
+        #  running cmd and everything it starts, like php-fpm under dash or
+        #  httpd under apachectl, which the shell wouldn't pass signals to
         defaults = {
             'stdout': subprocess.PIPE,
             'stderr': subprocess.STDOUT,
             'shell': True,
             'bufsize': 1,
-            'close_fds': True
+            'close_fds': True,
+            'preexec_fn': os.setsid
         }
         defaults.update(kwargs)
 
         super(Process, self).__init__(cmd, *args, **defaults)
 
+    def signal_group(self, signum):
+        """Send signum to every process in this process' group"""
+        try:
+            os.killpg(self.pid, signum)
+        except OSError:
+            pass  # the group has exited
+
+    def group_running(self):
+        """True while any process in this process' group is running"""
+        try:
+            os.killpg(self.pid, 0)
+            return True
+        except OSError:
+            return False
+
+    def running(self):
+        return self.poll() is None or self.group_running()
+
 
 class ProcessManager(object):
     """
@@ -92,14 +117,15 @@ class ProcessManager(object):
 
         pm.loop()
     """
-    def __init__(self):
+    def __init__(self, drain_timeout=5):
         self.processes = []
         self.queue = Queue()
         self.returncode = None
+        self.drain_timeout = drain_timeout
         self._terminating = False
         self._log = logging.getLogger('process')
 
-    def add_process(self, name, cmd, quiet=False):
+    def add_process(self, name, cmd, quiet=False, stop_signal=None):
         """
         Add a process to this manager instance:
 
@@ -109,9 +135,12 @@ class ProcessManager(object):
                       (e.g. 'worker'/'server')
         cmd         - the command-line used to run the process
                       (e.g. 'python run.py')
+        stop_signal - the signal which asks the process to stop,
+                      SIGTERM by default
         """
         self._log.debug("Adding process [%s] with cmd [%s]", name, cmd)
-        self.processes.append(Process(cmd, name=name, quiet=quiet))
+        self.processes.append(Process(cmd, name=name, quiet=quiet,
+                                      stop_signal=stop_signal))
 
     def loop(self):
         """
@@ -131,6 +160,8 @@ class ProcessManager(object):
         for proc in self.processes:
             self._log.info("Started [%s] with pid [%s]", proc.name, proc.pid)
 
+        signal.signal(signal.SIGTERM, self._on_sigterm)  # @UndefinedVariable
+
         while True:
             try:
                 proc, line = self.queue.get(timeout=0.1)
@@ -181,24 +212,37 @@ class ProcessManager(object):
 
         self._terminating = True
 
-        self._log.info("sending SIGTERM to all processes")
+        self._log.info("asking all processes to stop")
         for proc in self.processes:
-            if proc.poll() is None:
-                self._log.info("sending SIGTERM to pid [%d]", proc.pid)
-                proc.terminate()
+            if proc.running():
+                self._log.info("sending signal [%d] to group [%d]",
+                               proc.stop_signal, proc.pid)
+                proc.signal_group(proc.stop_signal)
 
         def kill(signum, frame):
             # If anything is still alive, SIGKILL it
             for proc in self.processes:
-                if proc.poll() is None:
-                    self._log.info("sending SIGKILL to pid [%d]", proc.pid)
-                    proc.kill()
+                if proc.running():
+                    self._log.info("sending SIGKILL to group [%d]", proc.pid)
+                    proc.signal_group(signal.SIGKILL)
+
+        # give in-flight requests drain_timeout seconds to finish
+        if self.drain_timeout > 0:
+            signal.signal(signal.SIGALRM, kill)  # @UndefinedVariable
+            signal.alarm(self.drain_timeout)  # @UndefinedVariable
+        else:
+            kill(None, None)
 
-        signal.signal(signal.SIGALRM, kill)  # @UndefinedVariable
-        signal.alarm(5)  # @UndefinedVariable
+    def _on_sigterm(self, signum, frame):
+        self._log.info("SIGTERM received, waiting up to [%d] seconds for "
+                       "processes to exit", self.drain_timeout)
+        if self.returncode is None:
+            self.returncode = 143
+        self.terminate()
 
     def _process_count(self):
-        return [p.poll() for p in self.processes].count(None)
+        # a draining daemon can outlive the shell which started it
+        return [p.running() for p in self.processes].count(True)
 
     def _init_readers(self):
         for proc in self.processes:
@@ -5,6 +5,7 @@ import logging
 import codecs
 import inspect
 import re
+import time
 from string import Template
 from runner import check_output
 
@@ -82,8 +83,15 @@ def process_extensions(ctx, to_call, success, args=None, ignore=False):
 def rewrite_with_template(template, cfgPath, ctx):
     with codecs.open(cfgPath, encoding='utf-8') as fin:
         data = fin.read()
+    data = template(data).safe_substitute(ctx)
+    # placeholders for unset variables are left as they are
+    for name in sorted(set(re.findall(
+            re.escape(template.delimiter) + r'\{([_a-zA-Z][_a-zA-Z0-9]*)\}',
+            data))):
+        _log.warning("[%s] is not set, leaving %s{%s} in [%s]",
+                     name, template.delimiter, name, cfgPath)
     with codecs.open(cfgPath, encoding='utf-8', mode='wt') as out:
-        out.write(template(data).safe_substitute(ctx))
+        out.write(data)
 
 
 def rewrite_cfgs(toPath, ctx, delim='#'):
@@ -101,6 +109,53 @@ def rewrite_cfgs(toPath, ctx, delim='#'):
         rewrite_with_template(RewriteTemplate, toPath, ctx)
 
 
+def is_valid_umask(umask):
+    return (re.match(r'^[0-7]{1,4}$', str(umask)) is not None and
+            int(str(umask), 8) <= 0777)
+
+
+def release_task_errors(tasks):
+    """Returns a list of problems with the RELEASE_TASKS map"""
+    if not hasattr(tasks, 'iteritems'):
+        return ['RELEASE_TASKS must map task names to commands']
+    errors = []
+    for name, cmd in sorted(tasks.iteritems()):
+        if not re.match(r'^[a-z][a-z0-9_-]*$', name) or name == 'web':
+            errors.append("{0} isn't a valid task name. Use lower case "
+                          "letters, digits, '-' and '_', other than "
+                          "'web'".format(name))
+        elif not hasattr(cmd, 'strip') or not cmd.strip():
+            errors.append("Task {0} must have a command".format(name))
+        elif '\n' in cmd or '\r' in cmd:
+            errors.append("The command of task {0} must be a single "
+                          "line".format(name))
+    return errors
+
+
+def umask_mode(ctx, mode):
+    """Returns `mode` with FILE_UMASK, if set, applied to it"""
+    umask = ctx.get('FILE_UMASK')
+    if umask is None or umask == '':
+        return mode
+    return mode & ~int(str(umask), 8)
+
+
+def apply_umask(ctx, path, mode=0644):
+    """Chmod path, or all files under path, to `mode` less FILE_UMASK.
+
+    Does nothing if FILE_UMASK is not set.
+    """
+    if ctx.get('FILE_UMASK') in (None, ''):
+        return
+    mode = umask_mode(ctx, mode)
+    if os.path.isdir(path):
+        for root, dirs, files in os.walk(path):
+            for f in files:
+                os.chmod(os.path.join(root, f), mode)
+    elif os.path.exists(path):
+        os.chmod(path, mode)
+
+
 def find_git_url(bp_dir):
     if os.path.exists(os.path.join(bp_dir, '.git')):
         try:
@@ -213,6 +268,24 @@ def unique(seq):
     return [x for x in seq if not (x in seen or seen_add(x))]
 
 
+def retry(func, tries, delay, should_retry=lambda e: True):
+    """Call func until it succeeds, at most `tries` times.
+
+    Failures for which should_retry returns False are raised right away.
+    The wait between attempts starts at `delay` seconds and doubles.
+    """
+    for attempt in range(tries):
+        try:
+            return func()
+        except Exception, e:
+            if attempt == tries - 1 or not should_retry(e):
+                raise
+            wait = delay * 2 ** attempt
+            _log.warning('Attempt %d of %d failed, retrying in %d seconds: %s',
+                         attempt + 1, tries, wait, e)
+            time.sleep(wait)
+
+
 # This is copytree from PyPy 2.7 source code.
 #   https://bitbucket.org/pypy/pypy/src/9d88b4875d6e/lib-python/2.7/shutil.py
 # Modifying this so that it doesn't care about an initial directory existing
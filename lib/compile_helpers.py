@@ -21,11 +21,36 @@ import logging
 import glob
 import subprocess
 import platform
+import datetime
+import json
+import sys
+import urllib
 from build_pack_utils import FileUtil
+from build_pack_utils import CloudFoundryInstaller
+from build_pack_utils import utils
+
+sys.path.append(os.path.join(os.path.dirname(os.path.abspath(__file__)), '..', 'vendor', 'node-semver'))
+from semver import max_satisfying
 
 
 _log = logging.getLogger('helpers')
 
+# Extensions which need native libraries that ship with the PHP
+# dependency, but outside of `php/lib`.  Paths are relative to the
+# PHP install directory.
+PHP_EXTENSION_LIB_DIRS = {
+    'gd': ['lib/gd'],
+    'imap': ['lib/imap'],
+    'ldap': ['lib/ldap'],
+    'sodium': ['lib/libsodium'],
+    'grpc': ['lib/grpc'],
+    'protobuf': ['lib/protobuf']
+}
+
+
+# Extensions which only work when loaded with `zend_extension=`
+ZEND_ONLY_EXTENSIONS = ('opcache', 'xdebug', 'ioncube')
+
 
 class FakeBuilder(object):
     def __init__(self, ctx):
@@ -38,6 +63,19 @@ class FakeInstaller(object):
         self.builder = builder
 
 
+def validate_webdir(ctx):
+    webdir = ctx['WEBDIR']
+    if os.path.isabs(webdir):
+        raise RuntimeError('WEBDIR [%s] must be a path relative to the '
+                           'application root' % webdir)
+    build_dir = os.path.normpath(ctx['BUILD_DIR'])
+    webdir_path = os.path.normpath(os.path.join(build_dir, webdir))
+    if webdir_path != build_dir and \
+            not webdir_path.startswith(build_dir + os.sep):
+        raise RuntimeError('WEBDIR [%s] must be located inside of the '
+                           'application root' % webdir)
+
+
 def setup_webdir_if_it_doesnt_exist(ctx):
     if is_web_app(ctx):
         webdirPath = os.path.join(ctx['BUILD_DIR'], ctx['WEBDIR'])
@@ -70,6 +108,93 @@ def setup_log_dir(ctx):
         os.makedirs(logPath)
 
 
+def _dir_size(path):
+    total = 0
+    for root, dirs, files in os.walk(path):
+        for f in files:
+            total += os.lstat(os.path.join(root, f)).st_size
+    return total
+
+
+def report_droplet_size(ctx):
+    size_mb = _dir_size(ctx['BUILD_DIR']) / (1024.0 * 1024.0)
+    _log.info('Droplet size is [%.1f] MB', size_mb)
+    print('Droplet size: {:.1f} MB'.format(size_mb))
+    threshold = ctx.get('DROPLET_SIZE_WARN_MB')
+    if threshold and size_mb > float(threshold):
+        _log.warning('Droplet size [%.1f] MB exceeds [%s] MB',
+                     size_mb, threshold)
+        print('WARNING: The droplet size ({:.1f} MB) exceeds DROPLET_SIZE_WARN_MB '
+              '({} MB). Check for files which do not need to be pushed, like a '
+              'committed `vendor` directory, and add them to `.cfignore`.'
+              .format(size_mb, threshold))
+
+
+def write_image_labels(ctx):
+    """Write OCI image labels for the droplet to `.bp/image-labels.json`,
+    when IMAGE_LABELS is set.  Tools which turn droplets into images can
+    apply them as the image's labels."""
+    if not _is_enabled(ctx.get('IMAGE_LABELS', False)):
+        return None
+    version_file = os.path.join(ctx['BP_DIR'], 'VERSION')
+    bp_version = 'unknown'
+    if os.path.exists(version_file):
+        with open(version_file) as f:
+            bp_version = f.read().strip()
+    labels = {
+        'org.opencontainers.image.created':
+            datetime.datetime.utcnow().strftime('%Y-%m-%dT%H:%M:%SZ'),
+        'org.cloudfoundry.php-buildpack.version': bp_version,
+        'org.cloudfoundry.php-buildpack.php-version': ctx.get('PHP_VERSION')
+    }
+    path = os.path.join(ctx['BUILD_DIR'], '.bp', 'image-labels.json')
+    utils.safe_makedirs(os.path.dirname(path))
+    with open(path, 'wt') as f:
+        json.dump(labels, f, indent=2, sort_keys=True)
+    _log.info('Wrote image labels to [%s]', path)
+    return path
+
+
+def prune_cache_dir(ctx):
+    """Remove the least recently used files from the cache directory, until
+    it fits in `BP_CACHE_MAX_MB`.  Returns the number of files removed."""
+    max_mb = ctx.get('BP_CACHE_MAX_MB')
+    if not max_mb:
+        return 0
+    if not re.match(r'^\d+$', str(max_mb)):
+        raise RuntimeError('BP_CACHE_MAX_MB must be a number of megabytes, '
+                           'got [%s]' % max_mb)
+    cache_dir = ctx['CACHE_DIR']
+    if not os.path.isdir(cache_dir):
+        return 0
+    budget = int(max_mb) * 1024 * 1024
+    entries = []
+    total = 0
+    for root, dirs, files in os.walk(cache_dir):
+        for f in files:
+            path = os.path.join(root, f)
+            st = os.lstat(path)
+            entries.append((max(st.st_atime, st.st_mtime), st.st_size, path))
+            total += st.st_size
+    if total <= budget:
+        return 0
+    removed = 0
+    for used, size, path in sorted(entries):
+        if total <= budget:
+            break
+        os.remove(path)
+        total -= size
+        removed += 1
+    for root, dirs, files in os.walk(cache_dir, topdown=False):
+        if root != cache_dir and not os.listdir(root):
+            os.rmdir(root)
+    _log.info('Removed [%d] files from the cache, it is now [%.1f] MB',
+              removed, total / (1024.0 * 1024.0))
+    print('Pruned {} least recently used files from the build cache to fit '
+          'BP_CACHE_MAX_MB ({} MB).'.format(removed, max_mb))
+    return removed
+
+
 def load_manifest(ctx):
     manifest_path = os.path.join(ctx['BP_DIR'], 'manifest.yml')
     _log.debug('Loading manifest from %s', manifest_path)
@@ -85,6 +210,20 @@ def find_all_php_versions(dependencies):
 
     return versions
 
+
+def find_php_eol_dates(manifest):
+    """Returns the end of life date of each PHP minor version, from the
+    manifest's `dependency_deprecation_dates`"""
+    dates = {}
+    for entry in manifest.get('dependency_deprecation_dates') or []:
+        if entry.get('name') != 'php':
+            continue
+        date = entry['date']
+        if not isinstance(date, datetime.date):
+            date = datetime.datetime.strptime(str(date), '%Y-%m-%d').date()
+        dates[str(entry['version_line'])] = date
+    return dates
+
  
 def validate_php_version(ctx):
     if ctx['PHP_VERSION'] in ctx['ALL_PHP_VERSIONS']:
@@ -98,6 +237,173 @@ def validate_php_version(ctx):
         warn_invalid_php_version(ctx['PHP_VERSION'], ctx['PHP_56_LATEST'], docs_link)
 
         ctx['PHP_VERSION'] = ctx['PHP_56_LATEST']
+    check_php_eol(ctx)
+
+
+def _php_minor(version):
+    return '.'.join(version.split('.')[0:2])
+
+
+def check_php_eol(ctx, today=None):
+    """Warn when the selected PHP is past its end of life.
+
+    PHP_EOL_DATES comes from the manifest, versions it doesn't list are
+    supported.  With `AUTO_UPGRADE_EOL_PHP` set, PHP_VERSION is moved to the
+    latest release of the nearest newer supported minor version within the
+    same major.
+    """
+    today = today or datetime.date.today()
+    eol_dates = ctx.get('PHP_EOL_DATES', None) or {}
+
+    def supported(version):
+        eol = eol_dates.get(_php_minor(version))
+        return eol is None or eol > today
+
+    def version_key(version):
+        return [int(x) for x in version.split('.')]
+
+    minor = _php_minor(ctx['PHP_VERSION'])
+    if supported(ctx['PHP_VERSION']):
+        return
+    eol = eol_dates[minor]
+    _log.warning('PHP [%s] reached end of life on [%s]',
+                 ctx['PHP_VERSION'], eol)
+    print('WARNING: PHP {} reached end of life on {} and no longer receives '
+          'security fixes. See: http://php.net/supported-versions.php'
+          .format(minor, eol))
+    if not _is_enabled(ctx.get('AUTO_UPGRADE_EOL_PHP', False)):
+        return
+    major = minor.split('.')[0]
+    candidates = sorted(
+        (v for v in ctx['ALL_PHP_VERSIONS']
+         if v.split('.')[0] == major and supported(v) and
+         version_key(v) > version_key(ctx['PHP_VERSION'])),
+        key=version_key)
+    if not candidates:
+        print('WARNING: No supported PHP {}.x is available, staying on {}.'
+              .format(major, ctx['PHP_VERSION']))
+        return
+    nearest = _php_minor(candidates[0])
+    upgrade = [v for v in candidates if _php_minor(v) == nearest][-1]
+    _log.info('Upgrading EOL PHP [%s] to [%s]', ctx['PHP_VERSION'], upgrade)
+    print('WARNING: AUTO_UPGRADE_EOL_PHP is set, using PHP {} instead of {}.'
+          .format(upgrade, ctx['PHP_VERSION']))
+    ctx['PHP_VERSION'] = upgrade
+
+
+def read_runtime_txt(ctx):
+    """Returns the PHP version in a Heroku style `runtime.txt`, or None
+
+    The file has a line like `php-7.2.3`, or `php-7.2` for the latest 7.2.
+    """
+    path = os.path.join(ctx['BUILD_DIR'], 'runtime.txt')
+    if not os.path.isfile(path):
+        return None
+    with open(path) as f:
+        for line in f:
+            m = re.match(r'^php-(\d+(\.\d+){0,2})$', line.strip())
+            if m:
+                return m.group(1)
+    _log.warning('Ignoring runtime.txt, it has no `php-<version>` line')
+    return None
+
+
+def setup_runtime_txt_version(ctx):
+    """Select PHP_VERSION from `runtime.txt`, composer.json overrides it"""
+    requested = read_runtime_txt(ctx)
+    if requested is None:
+        return
+    selected = max_satisfying(ctx['ALL_PHP_VERSIONS'], requested,
+                              loose=False)
+    if selected is None:
+        docs_link = 'http://docs.cloudfoundry.org/buildpacks/php/' \
+                    'gsg-php-config.html'
+        warn_invalid_php_version(requested, ctx['PHP_56_LATEST'], docs_link)
+        selected = ctx['PHP_56_LATEST']
+    _log.debug('runtime.txt picked PHP Version [%s]', selected)
+    ctx['PHP_VERSION'] = selected
+
+
+def warmup_dependency_cache(ctx):
+    """Fetch the dependencies in `DEPENDENCY_WARMUP` into the cache
+
+    Names map to the `<NAME>_DOWNLOAD_URL` option, so `php` fetches the
+    selected version of PHP.
+    """
+    urls = []
+    for name in ctx.get('DEPENDENCY_WARMUP', []):
+        key = '%s_DOWNLOAD_URL' % name.upper()
+        if key not in ctx:
+            _log.warning('Unknown dependency [%s] in DEPENDENCY_WARMUP', name)
+            print('WARNING: DEPENDENCY_WARMUP lists unknown dependency '
+                  '{}, it will not be cached.'.format(name))
+            continue
+        urls.append(ctx[key])
+    if urls:
+        _log.info('Warming the dependency cache with [%s]', ', '.join(urls))
+        CloudFoundryInstaller(ctx).warm_cache(urls)
+
+
+def validate_php_cli_version(ctx):
+    """Check if a separate PHP version should be installed for the CLI.
+
+    Returns True when `PHP_CLI_VERSION` is set, differs from the web
+    `PHP_VERSION` and is available in the build pack.  In that case the
+    context is setup so the `PHP_CLI` package can be installed.
+    """
+    cli_version = ctx.get('PHP_CLI_VERSION')
+    if not cli_version or cli_version == ctx['PHP_VERSION']:
+        return False
+    if cli_version not in ctx['ALL_PHP_VERSIONS']:
+        _log.warning('Selected CLI version of PHP [%s] not available.  '
+                     'Using [%s] for the CLI', cli_version, ctx['PHP_VERSION'])
+        print('WARNING: PHP_CLI_VERSION {} not available, using PHP {} '
+              'for the CLI.'.format(cli_version, ctx['PHP_VERSION']))
+        return False
+    _log.debug('App selected CLI PHP [%s]', cli_version)
+    ctx['PHP_CLI_DOWNLOAD_URL'] = \
+        '/php/{PHP_CLI_VERSION}/php-{PHP_CLI_VERSION}.tar.gz'
+    ctx['PHP_CLI_PACKAGE_INSTALL_DIR'] = 'php-cli'
+    ctx['PHP_CLI_STRIP'] = ctx.get('PHP_STRIP', False)
+    return True
+
+
+def needs_sodium_module(ctx):
+    """Sodium is bundled with PHP 7.2+, older versions need the module"""
+    if 'sodium' not in [ex.lower() for ex in ctx['PHP_EXTENSIONS']]:
+        return False
+    php_version = tuple(int(v) for v in ctx['PHP_VERSION'].split('.')[0:2])
+    return php_version < (7, 2)
+
+
+def manifest_php_modules(ctx):
+    """Returns the modules built for PHP_VERSION, from the manifest"""
+    for dependency in load_manifest(ctx)['dependencies']:
+        if dependency['name'] == 'php' and \
+                dependency['version'] == ctx['PHP_VERSION']:
+            return dependency.get('modules', [])
+    return []
+
+
+def setup_grpc_extensions(ctx):
+    """gRPC needs protobuf, so add it when grpc is requested.
+
+    Fails when the manifest has no grpc module for PHP_VERSION, rather than
+    letting the app fail on its first gRPC call.
+    """
+    requested = [ex.lower() for ex in ctx['PHP_EXTENSIONS']]
+    if 'grpc' not in requested:
+        return False
+    modules = manifest_php_modules(ctx)
+    for ex in ('grpc', 'protobuf'):
+        if ex not in modules:
+            raise RuntimeError('The %s extension, needed for gRPC, is not '
+                               'available for PHP %s. Choose a PHP version '
+                               'with a %s build.' % (ex, ctx['PHP_VERSION'],
+                                                     ex))
+    if 'protobuf' not in requested:
+        ctx['PHP_EXTENSIONS'] = list(ctx['PHP_EXTENSIONS']) + ['protobuf']
+    return True
 
 
 def _get_supported_php_extensions(ctx):
@@ -110,6 +416,30 @@ def _get_supported_php_extensions(ctx):
                 php_extensions.append(f.replace('.so', ''))
     return php_extensions
 
+def extension_dir_modules(ctx):
+    """Find the extensions in the app's `EXTENSION_DIRS`.
+
+    EXTENSION_DIRS lists directories relative to the app's root, which must
+    exist.  Returns a dict mapping extension names to their path at runtime,
+    the first directory listing an extension wins.
+    """
+    dirs = ctx.get('EXTENSION_DIRS', None) or []
+    if not isinstance(dirs, list):
+        raise RuntimeError('EXTENSION_DIRS must be a list, got [%s]' % dirs)
+    modules = {}
+    for ext_dir in dirs:
+        ext_dir = os.path.normpath(str(ext_dir)).strip('/')
+        path = os.path.join(ctx['BUILD_DIR'], ext_dir)
+        if ext_dir.startswith('..') or not os.path.isdir(path):
+            raise RuntimeError('EXTENSION_DIRS must list directories in the '
+                               'app, [%s] does not exist' % ext_dir)
+        for f in sorted(os.listdir(path)):
+            name, ext = os.path.splitext(f)
+            if ext == '.so' and name not in modules:
+                modules[name] = '@{HOME}/%s/%s' % (ext_dir, f)
+    return modules
+
+
 def _get_compiled_modules(ctx):
     if platform.system() != 'Linux':
         return []
@@ -136,7 +466,8 @@ def _get_compiled_modules(ctx):
 def validate_php_extensions(ctx):
     filtered_extensions = []
     requested_extensions = ctx['PHP_EXTENSIONS']
-    supported_extensions = _get_supported_php_extensions(ctx)
+    supported_extensions = (_get_supported_php_extensions(ctx) +
+                            list(extension_dir_modules(ctx)))
     compiled_modules = _get_compiled_modules(ctx)
 
     for extension in requested_extensions:
@@ -171,6 +502,66 @@ def validate_php_ini_extensions(ctx):
                 raise RuntimeError("The extension '%s' is not provided by this buildpack." % ext)
 
 
+def apply_extension_blocklist(ctx):
+    """Remove the extensions in EXTENSION_BLOCKLIST from those PHP loads.
+
+    EXTENSION_BLOCKLIST is a list, or a comma separated string so it can be
+    set in the environment.  Blocked extensions are left out with a warning,
+    or fail the build with EXTENSION_BLOCKLIST_STRICT.  Extensions loaded by
+    the app's own php.ini.d files can't be left out, so they always fail.
+    Returns the blocked extensions which were removed.
+    """
+    blocklist = ctx.get('EXTENSION_BLOCKLIST', None) or []
+    if not isinstance(blocklist, list):
+        blocklist = str(blocklist).split(',')
+    blocklist = set(str(ext).strip().lower() for ext in blocklist) - set([''])
+    if not blocklist:
+        return []
+    ini_files = glob.glob(os.path.join(ctx['BUILD_DIR'], '.bp-config', 'php',
+                                       'php.ini.d', '*.ini'))
+    for ini_file in ini_files:
+        for ext in _parse_extensions_from_ini_file(ini_file):
+            if ext.lower() in blocklist:
+                raise RuntimeError('The extension [%s], loaded by [%s], is in '
+                                   'EXTENSION_BLOCKLIST' % (
+                                       ext, os.path.basename(ini_file)))
+    blocked = []
+    for key in ('PHP_EXTENSIONS', 'ZEND_EXTENSIONS'):
+        kept = []
+        for ext in ctx.get(key, []):
+            if ext.lower() in blocklist:
+                blocked.append(ext)
+            else:
+                kept.append(ext)
+        ctx[key] = kept
+    if blocked and _is_enabled(ctx.get('EXTENSION_BLOCKLIST_STRICT', False)):
+        raise RuntimeError('These extensions are in EXTENSION_BLOCKLIST and '
+                           'can not be used: %s' % ', '.join(blocked))
+    for ext in blocked:
+        _log.warning('Extension [%s] is in EXTENSION_BLOCKLIST', ext)
+        print('WARNING: The extension [{}] is in EXTENSION_BLOCKLIST and will '
+              'not be loaded.'.format(ext))
+    return blocked
+
+
+def link_php_extension_lib_dirs(ctx):
+    php_dir = os.path.join(ctx['BUILD_DIR'], 'php')
+    php_lib_dir = os.path.join(php_dir, 'lib')
+    for extension in ctx['PHP_EXTENSIONS']:
+        for lib_dir in PHP_EXTENSION_LIB_DIRS.get(extension.lower(), []):
+            lib_dir_path = os.path.join(php_dir, lib_dir)
+            if not os.path.isdir(lib_dir_path):
+                continue
+            _log.debug('Linking [%s] libraries from [%s]',
+                       extension, lib_dir_path)
+            for name in os.listdir(lib_dir_path):
+                link_path = os.path.join(php_lib_dir, name)
+                if not os.path.lexists(link_path):
+                    os.symlink(os.path.relpath(os.path.join(lib_dir_path, name),
+                                               php_lib_dir),
+                               link_path)
+
+
 def include_fpm_d_confs(ctx):
     ctx['PHP_FPM_CONF_INCLUDE'] = ''
     php_fpm_d_path = os.path.join(ctx['BUILD_DIR'], '.bp-config', 'php', 'fpm.d')
@@ -178,16 +569,853 @@ def include_fpm_d_confs(ctx):
         ctx['PHP_FPM_CONF_INCLUDE'] = 'include=fpm.d/*.conf'
 
 
+def _is_enabled(val):
+    if hasattr(val, 'lower'):
+        return val.lower() in ('yes', 'true', 'on', '1')
+    return bool(val)
+
+
+def verbatim(lines):
+    """Returns config lines, joined by newlines, as a ctx value which
+    isn't formatted.
+
+    Otherwise ${HOME}, %{VAR}, @{TMPDIR} and regex quantifiers like {2}
+    would be taken for ctx keys.
+    """
+    if not hasattr(lines, 'strip'):
+        lines = '\n'.join(lines)
+    return utils.wrap(lines)
+
+
+def _php_ini_value(val):
+    if val is True:
+        return 'On'
+    if val is False:
+        return 'Off'
+    return str(val)
+
+
+def _php_ini_directives(directives):
+    lines = []
+    for key in sorted(directives.keys()):
+        val = directives[key]
+        if not re.match(r'^[A-Za-z_][A-Za-z0-9_.\-]*(\[[A-Za-z0-9_.\-]*\])?$', key):
+            print('WARNING: Ignoring PHP_INI_DIRECTIVES entry [{}], it is not '
+                  'a valid php.ini directive name.'.format(key))
+            continue
+        if key in ('extension', 'zend_extension'):
+            print('WARNING: Use PHP_EXTENSIONS or ZEND_EXTENSIONS instead of '
+                  'setting [{}] in PHP_INI_DIRECTIVES.'.format(key))
+        val = _php_ini_value(val)
+        if '\n' in val:
+            print('WARNING: Ignoring PHP_INI_DIRECTIVES entry [{}], the value '
+                  'must not span multiple lines.'.format(key))
+            continue
+        lines.append('%s = %s' % (key, val))
+    return '\n'.join(lines)
+
+
+# xdebug 2 profiles requests with XDEBUG_PROFILE set, see MEMORY_PROFILING
+MEMORY_PROFILING_DIRECTIVES = {
+    'xdebug.profiler_enable': False,
+    'xdebug.profiler_enable_trigger': True,
+    'xdebug.profiler_output_dir': '@{TMPDIR}',
+    'xdebug.profiler_output_name': 'cachegrind.out.%t.%p'
+}
+
+# the same for xdebug 3, which triggers on XDEBUG_PROFILE too
+MEMORY_PROFILING_XDEBUG3_DIRECTIVES = {
+    'xdebug.mode': 'profile',
+    'xdebug.start_with_request': 'trigger',
+    'xdebug.output_dir': '@{TMPDIR}',
+    'xdebug.profiler_output_name': 'cachegrind.out.%t.%p'
+}
+
+
+def _memory_profiling_directives(ctx):
+    """Returns the php.ini directives for MEMORY_PROFILING"""
+    if not _is_enabled(ctx.get('MEMORY_PROFILING', False)):
+        return {}
+    if xdebug_major_version(ctx) >= 3:
+        return dict(MEMORY_PROFILING_XDEBUG3_DIRECTIVES)
+    return dict(MEMORY_PROFILING_DIRECTIVES)
+
+
+def setup_memory_profiling(ctx):
+    """Load xdebug for profiling when `MEMORY_PROFILING` is set"""
+    if not _is_enabled(ctx.get('MEMORY_PROFILING', False)):
+        return False
+    if 'xdebug' not in ctx['ZEND_EXTENSIONS']:
+        ctx['ZEND_EXTENSIONS'] = list(ctx['ZEND_EXTENSIONS']) + ['xdebug']
+    _log.warning('MEMORY_PROFILING is enabled, loading xdebug')
+    print('WARNING: MEMORY_PROFILING is enabled. xdebug is loaded and adds '
+          'overhead to every request, do not use this in production. Send '
+          'XDEBUG_PROFILE with a request to write a profile to $TMPDIR.')
+    return True
+
+
+# written by the composer extension, see OPCACHE_PRELOAD_COMPOSER
+OPCACHE_PRELOAD_SCRIPT = os.path.join('.bp', 'opcache-preload.php')
+
+
+def opcache_preload_composer(ctx):
+    """Returns True if OPCACHE_PRELOAD_COMPOSER is set and PHP supports
+    opcache.preload, which is PHP 7.4 and newer"""
+    if not _is_enabled(ctx.get('OPCACHE_PRELOAD_COMPOSER', False)):
+        return False
+    php_version = tuple(int(v) for v in ctx['PHP_VERSION'].split('.')[0:2])
+    return php_version >= (7, 4)
+
+
+def setup_opcache_preload(ctx):
+    """Load opcache for OPCACHE_PRELOAD_COMPOSER, when PHP supports it"""
+    if not _is_enabled(ctx.get('OPCACHE_PRELOAD_COMPOSER', False)):
+        return False
+    if not opcache_preload_composer(ctx):
+        print('WARNING: OPCACHE_PRELOAD_COMPOSER requires PHP 7.4 or newer '
+              'and will be ignored for PHP {}.'.format(ctx['PHP_VERSION']))
+        return False
+    if 'opcache' not in ctx['ZEND_EXTENSIONS']:
+        ctx['ZEND_EXTENSIONS'] = list(ctx['ZEND_EXTENSIONS']) + ['opcache']
+    return True
+
+
+XDEBUG_DEFAULTS = {
+    'enabled': False,
+    'mode': 'debug',
+    'client_host': 'localhost',
+    'client_port': 9003
+}
+
+
+def _xdebug_options(ctx):
+    """Returns the XDEBUG options, merged with XDEBUG_DEFAULTS"""
+    opts = dict(XDEBUG_DEFAULTS)
+    opts.update(ctx.get('XDEBUG', None) or {})
+    if not re.match(r'^[a-z,]+$', str(opts['mode'])):
+        raise RuntimeError('XDEBUG mode must be a list of xdebug modes '
+                           'like `debug,develop`, got [%s]' % opts['mode'])
+    if not re.match(r'^[A-Za-z0-9_.:\-]+$', str(opts['client_host'])):
+        raise RuntimeError('XDEBUG client_host must be a host name or IP, '
+                           'got [%s]' % opts['client_host'])
+    if not re.match(r'^\d+$', str(opts['client_port'])):
+        raise RuntimeError('XDEBUG client_port must be a port number, '
+                           'got [%s]' % opts['client_port'])
+    return opts
+
+
+def xdebug_major_version(ctx):
+    """Returns 2 or 3, the major version of the installed xdebug.so.
+
+    xdebug 3 renamed most of its settings, so the binary is checked for the
+    `xdebug.client_host` setting it registers.  Without an installed xdebug
+    PHP 8 and newer are assumed to ship xdebug 3 and older PHP xdebug 2.
+    """
+    pattern = os.path.join(ctx.get('PHP_INSTALL_PATH', ''), 'lib', 'php',
+                           'extensions', 'no-debug-non-zts-*', 'xdebug.so')
+    for path in glob.glob(pattern):
+        with open(path, 'rb') as f:
+            return 3 if b'xdebug.client_host' in f.read() else 2
+    php_version = str(ctx.get('PHP_VERSION', '')).split('.')[0]
+    return 3 if php_version.isdigit() and int(php_version) >= 8 else 2
+
+
+# xdebug 2 has a setting per feature where xdebug 3 has `xdebug.mode`
+XDEBUG2_MODES = {
+    'debug': 'xdebug.remote_enable',
+    'profile': 'xdebug.profiler_enable',
+    'trace': 'xdebug.auto_trace'
+}
+
+
+def _xdebug_directives(ctx):
+    """Returns the php.ini directives for XDEBUG, empty when disabled"""
+    opts = _xdebug_options(ctx)
+    if not _is_enabled(opts['enabled']) or \
+            str(ctx.get('BP_ENV', '')).lower() == 'production':
+        return {}
+    if xdebug_major_version(ctx) >= 3:
+        return {
+            'xdebug.mode': opts['mode'],
+            'xdebug.client_host': opts['client_host'],
+            'xdebug.client_port': int(opts['client_port'])
+        }
+    directives = {
+        'xdebug.remote_host': opts['client_host'],
+        'xdebug.remote_port': int(opts['client_port'])
+    }
+    for mode in opts['mode'].split(','):
+        if mode in XDEBUG2_MODES:
+            directives[XDEBUG2_MODES[mode]] = True
+    return directives
+
+
+def setup_xdebug(ctx):
+    """Load xdebug when `XDEBUG` is enabled, never with BP_ENV=production"""
+    opts = _xdebug_options(ctx)
+    if not _is_enabled(opts['enabled']):
+        return False
+    if str(ctx.get('BP_ENV', '')).lower() == 'production':
+        _log.warning('XDEBUG is enabled with BP_ENV=production, ignoring it')
+        print('WARNING: XDEBUG is enabled, but BP_ENV is `production`. '
+              'xdebug will NOT be loaded. Only enable XDEBUG for staging '
+              'or debug environments.')
+        return False
+    if 'xdebug' not in ctx['ZEND_EXTENSIONS']:
+        ctx['ZEND_EXTENSIONS'] = list(ctx['ZEND_EXTENSIONS']) + ['xdebug']
+    _log.warning('XDEBUG is enabled, loading xdebug')
+    print('WARNING: XDEBUG is enabled. xdebug is loaded in [%s] mode, which '
+          'slows down every request and may expose the app to a debugger '
+          'at %s:%s. Never use this in production.' % (
+              opts['mode'], opts['client_host'], opts['client_port']))
+    return True
+
+
+# opt-in with PHP_ADMIN_SECURE_DEFAULTS, these let PHP code run programs
+SECURE_DISABLE_FUNCTIONS = ('exec', 'passthru', 'shell_exec', 'system',
+                            'proc_open', 'popen', 'pcntl_exec')
+
+
+def _php_admin_values(ctx):
+    values = {}
+    if _is_enabled(ctx.get('PHP_ADMIN_SECURE_DEFAULTS', False)):
+        values['disable_functions'] = ','.join(SECURE_DISABLE_FUNCTIONS)
+    values.update(ctx.get('PHP_ADMIN_VALUES', {}))
+    lines = []
+    for key in sorted(values.keys()):
+        val = values[key]
+        if not re.match(r'^[A-Za-z_][A-Za-z0-9_.\-]*$', key):
+            print('WARNING: Ignoring PHP_ADMIN_VALUES entry [{}], it is not '
+                  'a valid php.ini directive name.'.format(key))
+            continue
+        if val is True or val is False:
+            lines.append('php_admin_flag[%s] = %s' % (
+                key, val and 'on' or 'off'))
+            continue
+        val = str(val)
+        if '\n' in val:
+            print('WARNING: Ignoring PHP_ADMIN_VALUES entry [{}], the value '
+                  'must not span multiple lines.'.format(key))
+            continue
+        lines.append('php_admin_value[%s] = %s' % (key, val))
+    return '\n'.join(lines)
+
+
+def _validate_non_negative_int(ctx, key, default):
+    val = ctx.get(key, default)
+    if not re.match(r'^\d+$', str(val)):
+        raise RuntimeError('%s must be a non-negative integer, got [%s]' %
+                           (key, val))
+    ctx[key] = int(val)
+
+
+def request_terminate_timeout(ctx):
+    """Returns the FPM request_terminate_timeout in seconds, 0 is no limit.
+
+    None when PHP_FPM_REQUEST_TERMINATE_TIMEOUT isn't set, FPM's own
+    default of no limit is kept then.
+    """
+    if ctx.get('PHP_FPM_REQUEST_TERMINATE_TIMEOUT') is None:
+        return None
+    _validate_non_negative_int(ctx, 'PHP_FPM_REQUEST_TERMINATE_TIMEOUT', 0)
+    return ctx['PHP_FPM_REQUEST_TERMINATE_TIMEOUT']
+
+
+def default_locale(ctx):
+    locale = ctx.get('DEFAULT_LOCALE', 'C.UTF-8')
+    if not re.match(r'^[A-Za-z0-9_.@-]+$', locale):
+        raise RuntimeError('DEFAULT_LOCALE is not a valid locale name, '
+                           'got [%s]' % locale)
+    return locale
+
+
+def php_ini_scan_dirs(ctx):
+    """Returns the directories PHP scans for ini files, in order.
+
+    php/etc/php.ini.d comes first, when it exists or PHP_INI_SCAN_DIRS is
+    set, then the PHP_INI_SCAN_DIRS.  Relative ones are in the app.
+    """
+    extra = ctx.get('PHP_INI_SCAN_DIRS', None) or []
+    if hasattr(extra, 'strip'):
+        extra = [extra]
+    dirs = []
+    php_ini_d_path = os.path.join(ctx['BUILD_DIR'], 'php', 'etc', 'php.ini.d')
+    if extra or os.path.exists(php_ini_d_path):
+        dirs.append('$HOME/php/etc/php.ini.d/')
+    for path in extra:
+        if not re.match(r'^[A-Za-z0-9_./$-]+$', path) or '..' in path:
+            raise RuntimeError('PHP_INI_SCAN_DIRS must be paths in the app '
+                               'like `config/php`, got [%s]' % path)
+        if not path.startswith('/') and not path.startswith('$'):
+            path = '$HOME/%s' % path
+        if path not in dirs:
+            dirs.append(path)
+    return dirs
+
+
+def template_env(ctx):
+    """Returns TEMPLATE_ENV, variables bin/rewrite always puts into configs.
+
+    TEMPLATE_ENV is a list, or a comma separated string so it can be set
+    in the environment.  Every variable in the environment is replaced in
+    `@{...}` placeholders at startup, the ones listed here are replaced with
+    an empty value when they aren't set instead of being left as they are.
+    """
+    names = ctx.get('TEMPLATE_ENV', None) or []
+    if hasattr(names, 'strip'):
+        names = names.split(',')
+    names = [str(name).strip() for name in names if str(name).strip()]
+    for name in names:
+        if not re.match(r'^[A-Za-z_][A-Za-z0-9_]*$', name):
+            raise RuntimeError('TEMPLATE_ENV must list environment variable '
+                               'names, got [%s]' % name)
+    return names
+
+
+def upload_tmp_dir(ctx):
+    """Returns UPLOAD_TMP_DIR, where PHP writes uploads, @{TMPDIR} by default"""
+    # not formatted, so runtime values like @{HOME} are kept as they are
+    path = ctx.get('UPLOAD_TMP_DIR', format=False) or '@{TMPDIR}'
+    if not re.match(r'^(/|@\{[A-Z_]+\})[^"\n]*$', path):
+        raise RuntimeError('UPLOAD_TMP_DIR must be an absolute path or start '
+                           'with a variable like `@{HOME}`, got [%s]' % path)
+    return path
+
+
+def upload_tmp_dir_commands(ctx):
+    """Commands which create UPLOAD_TMP_DIR at startup, warn if it is not
+    writable and remove uploads left over from an earlier run"""
+    if not ctx.get('UPLOAD_TMP_DIR', format=False):
+        return ()
+    path = re.sub(r'@\{([A-Z_]+)\}', r'${\1}', upload_tmp_dir(ctx))
+    return (('mkdir', '-p', '"%s"' % path),
+            ('[ -w "%s" ] ||' % path,
+             'echo "WARNING: UPLOAD_TMP_DIR [%s] is not writable, uploads '
+             'will fail"' % path),
+            ('find', '"%s"' % path,
+             '-maxdepth 1 -type f -name "php*" -mmin +60 -delete'))
+
+
+def otel_resource_attributes(ctx):
+    """Returns OTEL_RESOURCE_ATTRIBUTES for the app, '' without OTEL.
+
+    OTEL can set `service_name`, `service_version` and `environment`,
+    the first two default to the app's name and version.  More attributes
+    can be set with the `attributes` object.
+    """
+    otel = ctx.get('OTEL', None)
+    if not otel:
+        return ''
+    if not hasattr(otel, 'get'):
+        raise RuntimeError('OTEL must be an object, got [%s]' % otel)
+    vcap_app = ctx.get('VCAP_APPLICATION', {}) or {}
+    attrs = [
+        ('service.name', otel.get('service_name') or
+            vcap_app.get('application_name') or vcap_app.get('name')),
+        ('service.version', otel.get('service_version') or
+            vcap_app.get('application_version')),
+        ('deployment.environment', otel.get('environment'))
+    ]
+    extra = otel.get('attributes', {}) or {}
+    for key in sorted(extra.keys()):
+        attrs.append((key, extra[key]))
+    pairs = []
+    for key, val in attrs:
+        if val is None or val == '':
+            continue
+        if not re.match(r'^[A-Za-z0-9_.\-]+$', key):
+            raise RuntimeError('OTEL attribute names must be like '
+                               '`service.namespace`, got [%s]' % key)
+        # values are percent encoded, like W3C baggage
+        pairs.append('%s=%s' % (key, urllib.quote(str(val), safe='-._~/:')))
+    return ','.join(pairs)
+
+
+SECRETS_PROFILE_SCRIPT = '''# Exports every file in {secrets_dir} as an environment variable
+if [ -d "{secrets_dir}" ]; then
+    for secret in "{secrets_dir}"/*; do
+        [ -f "$secret" ] || continue
+        name=$(basename "$secret")
+        case "$name" in
+            [!A-Za-z_]* | *[!A-Za-z0-9_]*) continue ;;
+        esac
+        export "$name=$(cat "$secret")"
+    done
+fi
+'''
+
+
+def write_secrets_profile(ctx):
+    """Write a profile.d script which exports the files in `SECRETS_DIR`.
+
+    The directory is read when the app starts, so the secrets in it are not
+    copied into the droplet.  Each file becomes an environment variable with
+    the file's name, names which are not valid variable names are skipped.
+    """
+    secrets_dir = ctx.get('SECRETS_DIR')
+    if not secrets_dir:
+        return
+    if not re.match(r'^/[^\s\'"\\`$]*$', secrets_dir):
+        raise RuntimeError('SECRETS_DIR must be an absolute path, '
+                           'got [%s]' % secrets_dir)
+    profile_d = os.path.join(ctx['BUILD_DIR'], '.profile.d')
+    if not os.path.exists(profile_d):
+        os.makedirs(profile_d)
+    with open(os.path.join(profile_d, 'bp_secrets.sh'), 'w') as f:
+        f.write(SECRETS_PROFILE_SCRIPT.format(
+            secrets_dir=secrets_dir.rstrip('/') or '/'))
+    _log.info('Secrets will be read from [%s] at startup', secrets_dir)
+
+
+def php_error_log(ctx):
+    """Returns where PHP_ERROR_LOG sends errors, `stderr` by default"""
+    # not formatted, so runtime values like @{HOME} are kept as they are
+    error_log = ctx.get('PHP_ERROR_LOG', format=False) or 'stderr'
+    if '\n' in error_log or '"' in error_log:
+        raise RuntimeError('PHP_ERROR_LOG must be `stderr` or a path, '
+                           'got [%s]' % error_log)
+    return error_log
+
+
+def php_output_buffering(ctx):
+    """Returns PHP's output_buffering, `Off`, `On` or a size in bytes.
+
+    Streamed responses, like server-sent events, need it `Off`.  Apache
+    buffers what it gets from PHP-FPM too, so then it is told to flush
+    every packet, see setup_php_proxy_flush in the httpd extension.
+    mod_deflate buffers compressed responses as well, so streamed
+    responses should also be sent with a type that's not compressed.
+    """
+    val = ctx.get('PHP_OUTPUT_BUFFERING', 4096)
+    if str(val).lower() in ('true', 'on'):
+        return 'On'
+    if str(val).lower() in ('false', 'off', '0'):
+        return 'Off'
+    if not re.match(r'^\d+$', str(val)):
+        raise RuntimeError('PHP_OUTPUT_BUFFERING must be `on`, `off` or a '
+                           'size in bytes, got [%s]' % val)
+    return int(val)
+
+
+def setup_php_ini_options(ctx):
+    error_log = php_error_log(ctx)
+    if error_log == 'stderr':
+        ctx['PHP_INI_ERROR_LOG_CONF'] = 'error_log = /dev/stderr'
+    else:
+        ctx['PHP_INI_ERROR_LOG_CONF'] = verbatim(
+            'error_log = "%s"' % error_log)
+    ctx['PHP_INI_EXPOSE_PHP'] = \
+        _is_enabled(ctx.get('EXPOSE_PHP', False)) and 'On' or 'Off'
+    _validate_non_negative_int(ctx, 'PHP_MAX_EXECUTION_TIME', 30)
+    _validate_non_negative_int(ctx, 'PHP_MAX_INPUT_VARS', 1000)
+    ctx['PHP_INI_OUTPUT_BUFFERING'] = php_output_buffering(ctx)
+    ctx['PHP_INI_IMPLICIT_FLUSH'] = _php_ini_value(
+        _is_enabled(ctx.get('PHP_IMPLICIT_FLUSH', False)))
+    locale = default_locale(ctx)
+    if 'intl' in ctx.get('PHP_EXTENSIONS', []):
+        ctx['PHP_INI_INTL_DEFAULT_LOCALE_CONF'] = \
+            'intl.default_locale = %s' % locale
+    else:
+        ctx['PHP_INI_INTL_DEFAULT_LOCALE_CONF'] = ';intl.default_locale ='
+    # containers are short lived, so run session gc on 1% of requests
+    _validate_non_negative_int(ctx, 'PHP_SESSION_GC_MAXLIFETIME', 1440)
+    _validate_non_negative_int(ctx, 'PHP_SESSION_GC_PROBABILITY', 1)
+    _validate_non_negative_int(ctx, 'PHP_SESSION_GC_DIVISOR', 100)
+    if ctx['PHP_SESSION_GC_DIVISOR'] == 0:
+        raise RuntimeError('PHP_SESSION_GC_DIVISOR must be greater than 0')
+    # a short timeout lets outbound calls to slow services fail fast
+    _validate_non_negative_int(ctx, 'DEFAULT_SOCKET_TIMEOUT', 60)
+    if ctx['DEFAULT_SOCKET_TIMEOUT'] == 0:
+        raise RuntimeError('DEFAULT_SOCKET_TIMEOUT must be greater than 0')
+    ctx['PHP_INI_UPLOAD_TMP_DIR_CONF'] = verbatim(
+        'upload_tmp_dir = "%s"' % upload_tmp_dir(ctx))
+    setup_assertions(ctx)
+    setup_zlib_output_compression(ctx)
+    _validate_non_negative_int(ctx, 'SOAP_WSDL_CACHE_TTL', 86400)
+    # not formatted, so runtime values like @{HOME} are kept as they are
+    cache_dir = ctx.get('SOAP_WSDL_CACHE_DIR', format=False) or '@{TMPDIR}'
+    if 'soap' in ctx.get('PHP_EXTENSIONS', []):
+        ctx['PHP_INI_SOAP_WSDL_CACHE_DIR_CONF'] = verbatim(
+            'soap.wsdl_cache_dir="%s"' % cache_dir)
+        ctx['PHP_INI_SOAP_WSDL_CACHE_TTL_CONF'] = \
+            'soap.wsdl_cache_ttl=%d' % ctx['SOAP_WSDL_CACHE_TTL']
+    else:
+        ctx['PHP_INI_SOAP_WSDL_CACHE_DIR_CONF'] = \
+            verbatim(';soap.wsdl_cache_dir="@{TMPDIR}"')
+        ctx['PHP_INI_SOAP_WSDL_CACHE_TTL_CONF'] = ';soap.wsdl_cache_ttl=86400'
+    directives = {}
+    directives.update(_memory_profiling_directives(ctx))
+    xdebug = _xdebug_directives(ctx)
+    if 'xdebug.mode' in xdebug and 'xdebug.mode' in directives:
+        xdebug['xdebug.mode'] = ','.join(
+            [directives['xdebug.mode'], xdebug['xdebug.mode']])
+    directives.update(xdebug)
+    if opcache_preload_composer(ctx):
+        directives['opcache.preload'] = '@{HOME}/%s' % OPCACHE_PRELOAD_SCRIPT
+    directives.update(ctx.get('PHP_INI_DIRECTIVES', {}))
+    ctx['PHP_INI_DIRECTIVES_CONF'] = verbatim(
+        _php_ini_directives(directives))
+
+
+def setup_assertions(ctx):
+    """Set zend.assertions and assert.exception, for PHP 7.
+
+    PHP_ZEND_ASSERTIONS defaults to -1, which compiles assertions out,
+    unless BP_ENV is set to something other than `production`.
+    """
+    bp_env = str(ctx.get('BP_ENV', '') or 'production').lower()
+    default = bp_env == 'production' and -1 or 1
+    assertions = ctx.get('PHP_ZEND_ASSERTIONS', None)
+    if assertions is None or assertions == '':
+        assertions = default
+    if str(assertions) not in ('-1', '0', '1'):
+        raise RuntimeError('PHP_ZEND_ASSERTIONS must be -1, 0 or 1, '
+                           'got [%s]' % assertions)
+    exception = _is_enabled(ctx.get('PHP_ASSERT_EXCEPTION', True))
+    ctx['PHP_INI_ASSERTIONS_CONF'] = '\n'.join([
+        ';assert.active = On',
+        'zend.assertions = %s' % assertions,
+        'assert.exception = %s' % _php_ini_value(exception)])
+
+
+def setup_zlib_output_compression(ctx):
+    """Set zlib.output_compression from ZLIB_OUTPUT_COMPRESSION, `true`,
+    `false` (the default) or a compression level from 1 to 9.
+
+    The web server compresses responses too, so this shows a warning when
+    it's turned on.
+    """
+    val = ctx.get('ZLIB_OUTPUT_COMPRESSION', False)
+    level = -1
+    if str(val).lower() in ('false', 'off', '0', ''):
+        enabled = False
+    elif str(val).lower() in ('true', 'on'):
+        enabled = True
+    elif re.match(r'^[1-9]$', str(val)):
+        (enabled, level) = (True, int(val))
+    else:
+        raise RuntimeError('ZLIB_OUTPUT_COMPRESSION must be `true`, `false` '
+                           'or a level from 1 to 9, got [%s]' % val)
+    ctx['PHP_INI_ZLIB_OUTPUT_COMPRESSION'] = _php_ini_value(enabled)
+    ctx['PHP_INI_ZLIB_OUTPUT_COMPRESSION_LEVEL_CONF'] = \
+        '%szlib.output_compression_level = %d' % (not enabled and ';' or '',
+                                                  level)
+    web_server = ctx.get('WEB_SERVER', 'httpd')
+    if enabled and web_server in ('httpd', 'nginx'):
+        msg = ('ZLIB_OUTPUT_COMPRESSION is on, but %s compresses responses '
+               'as well (with %s). Compressing twice only costs CPU, so '
+               'use one or the other.' % (
+                   web_server,
+                   web_server == 'httpd' and 'mod_deflate' or 'gzip'))
+        _log.warning(msg)
+        print('WARNING: %s' % msg)
+
+
+def php_file_extensions(ctx):
+    """Returns PHP_FILE_EXTENSIONS, the extensions of files run by PHP"""
+    exts = [str(ext).lstrip('.')
+            for ext in ctx.get('PHP_FILE_EXTENSIONS', None) or ['php']]
+    for ext in exts:
+        if not re.match(r'^[A-Za-z0-9]+$', ext):
+            raise RuntimeError('PHP_FILE_EXTENSIONS must be file extensions '
+                               'like `.php`, got [%s]' % ext)
+    return exts
+
+
+# PHP's own defaults, when the installed configs don't set these
+PHP_MEMORY_LIMIT = '128M'
+FPM_MAX_CHILDREN = 5
+
+
+def _memory_bytes(val):
+    """Parse sizes like `128M` or `1g` into bytes, None when unlimited"""
+    m = re.match(r'^\s*(-?\d+)\s*([KMGkmg]?)[Bb]?\s*$', str(val))
+    if not m or int(m.group(1)) < 0:
+        return None
+    return int(m.group(1)) * 1024 ** ' KMG'.index(m.group(2).upper() or ' ')
+
+
+def container_memory_limit():
+    """Returns the app's memory limit in bytes, or None if it's unknown"""
+    if os.getenv('MEMORY_LIMIT'):
+        return _memory_bytes(os.getenv('MEMORY_LIMIT'))
+    try:
+        limits = json.loads(os.getenv('VCAP_APPLICATION', '{}'))['limits']
+        return int(limits['mem']) * 1024 * 1024
+    except (ValueError, KeyError, TypeError):
+        pass
+    try:
+        with open('/sys/fs/cgroup/memory/memory.limit_in_bytes') as f:
+            limit = int(f.read().strip())
+        # cgroups without a limit report a huge number
+        return limit < 2 ** 50 and limit or None
+    except (IOError, ValueError):
+        return None
+
+
+def _ini_files(path, conf, conf_dir, ext):
+    """Returns `conf` under `path` and the files in `conf_dir`, in the
+    order PHP or FPM read them"""
+    files = [os.path.join(path, conf)]
+    conf_dir = os.path.join(path, conf_dir)
+    if os.path.isdir(conf_dir):
+        files.extend(os.path.join(conf_dir, f)
+                     for f in sorted(os.listdir(conf_dir)) if f.endswith(ext))
+    return [f for f in files if os.path.isfile(f)]
+
+
+def _ini_settings(files, key):
+    """Returns (section, value) for each setting of `key` in the files"""
+    settings = []
+    section = None
+    for path in files:
+        with open(path, 'rt') as f:
+            for line in f:
+                line = line.split(';', 1)[0].strip()
+                m = re.match(r'^\[(.+)\]$', line)
+                if m:
+                    section = m.group(1)
+                    continue
+                m = re.match(r'^%s\s*=\s*(.*)$' % re.escape(key), line)
+                if m:
+                    settings.append((section, m.group(1).strip().strip('"\'')))
+    return settings
+
+
+def installed_memory_limit(ctx):
+    """Returns memory_limit from the installed php.ini and php.ini.d"""
+    path = os.path.join(ctx['BUILD_DIR'], 'php', 'etc')
+    settings = _ini_settings(
+        _ini_files(path, 'php.ini', 'php.ini.d', '.ini'), 'memory_limit')
+    return settings and settings[-1][1] or PHP_MEMORY_LIMIT
+
+
+def installed_fpm_max_children(ctx):
+    """Returns pm.max_children, added up over the installed FPM pools"""
+    path = os.path.join(ctx['BUILD_DIR'], 'php', 'etc')
+    pools = dict(_ini_settings(
+        _ini_files(path, 'php-fpm.conf', 'fpm.d', '.conf'), 'pm.max_children'))
+    children = [int(val) for val in pools.values() if val.isdigit()]
+    return children and sum(children) or FPM_MAX_CHILDREN
+
+
+def check_memory_limit(ctx):
+    """Warn when PHP's memory_limit across all FPM workers doesn't fit in
+    the container, a busy app would be OOM-killed.  Returns True if so.
+
+    Reads both from the installed configs, so it runs after they're written.
+    """
+    container = container_memory_limit()
+    memory_limit = installed_memory_limit(ctx)
+    per_worker = _memory_bytes(memory_limit)
+    if not container or not per_worker:
+        return False
+    max_children = installed_fpm_max_children(ctx)
+    total = per_worker * max_children
+    if total <= container:
+        return False
+    mb = 1024 * 1024
+    _log.warning('memory_limit [%s] x [%d] workers exceeds the container '
+                 'memory [%d] MB', memory_limit, max_children,
+                 container / mb)
+    print('WARNING: memory_limit {} x {} PHP-FPM workers = {} MB, which is '
+          'more than the {} MB of memory for this app. PHP can be '
+          'OOM-killed under load. Lower memory_limit or pm.max_children, '
+          'or give the app more memory.'.format(
+              memory_limit, max_children, total / mb, container / mb))
+    return True
+
+
+def fpm_status_path(ctx):
+    """Returns the FPM status page path or None when it's disabled
+
+    `PHP_FPM_STATUS` may be a boolean, which uses `/fpm-status`, or a path.
+    """
+    status = ctx.get('PHP_FPM_STATUS', False)
+    if hasattr(status, 'startswith') and status.startswith('/'):
+        return status
+    if _is_enabled(status):
+        return '/fpm-status'
+    return None
+
+
+def fpm_ping_path(ctx):
+    """Returns the FPM ping path or None when it's disabled
+
+    `PHP_FPM_PING` may be a boolean, which uses `/fpm-ping`, or a path.
+    """
+    ping = ctx.get('PHP_FPM_PING', False)
+    if hasattr(ping, 'startswith') and ping.startswith('/'):
+        return ping
+    if _is_enabled(ping):
+        return '/fpm-ping'
+    return None
+
+
+def setup_fpm_listen_permissions(ctx):
+    """Set listen.owner, listen.group and listen.mode when PHP-FPM listens
+    on a unix socket.
+
+    The web server runs as the same user as PHP-FPM, so FPM's defaults, the
+    running user and group with mode 0660, let it connect.
+    PHP_FPM_LISTEN_OWNER, PHP_FPM_LISTEN_GROUP and PHP_FPM_LISTEN_MODE
+    change them.  They are left out when FPM listens on a TCP port.
+    """
+    socket = str(ctx.get('PHP_FPM_LISTEN', '')).startswith('/')
+    for key, directive, default, pattern in (
+            ('PHP_FPM_LISTEN_OWNER', 'listen.owner', None,
+             r'^([a-z_][a-z0-9_-]*|\d+)$'),
+            ('PHP_FPM_LISTEN_GROUP', 'listen.group', None,
+             r'^([a-z_][a-z0-9_-]*|\d+)$'),
+            ('PHP_FPM_LISTEN_MODE', 'listen.mode', '0660', r'^0?[0-7]{3}$')):
+        val = ctx.get(key, None) or default
+        if val and not re.match(pattern, str(val)):
+            raise RuntimeError('%s must be a valid %s, got [%s]' % (
+                key, directive, val))
+        if socket and val:
+            ctx['%s_CONF' % key] = '%s = %s' % (directive, val)
+        else:
+            ctx['%s_CONF' % key] = ';%s = %s' % (directive,
+                                                 default or 'nobody')
+
+
+def setup_fpm_pool_options(ctx):
+    # -1 is the OS maximum, FPM would otherwise cap it at 65535
+    backlog = ctx.get('PHP_FPM_LISTEN_BACKLOG', -1)
+    if not re.match(r'^(-1|[1-9]\d*)$', str(backlog)):
+        raise RuntimeError('PHP_FPM_LISTEN_BACKLOG must be a positive integer '
+                           'or -1, got [%s]' % backlog)
+    ctx['PHP_FPM_LISTEN_BACKLOG'] = int(backlog)
+    setup_fpm_listen_permissions(ctx)
+    terminate = request_terminate_timeout(ctx)
+    if terminate is None:
+        ctx['PHP_FPM_REQUEST_TERMINATE_TIMEOUT_CONF'] = \
+            ';request_terminate_timeout = 0'
+    else:
+        ctx['PHP_FPM_REQUEST_TERMINATE_TIMEOUT_CONF'] = \
+            'request_terminate_timeout = %d' % terminate
+    # recycle workers, so memory leaked by extensions is given back
+    _validate_non_negative_int(ctx, 'PHP_FPM_MAX_REQUESTS', 500)
+    catch_output = _is_enabled(ctx.get('PHP_FPM_CATCH_WORKERS_OUTPUT', True))
+    if not catch_output and php_error_log(ctx) == 'stderr':
+        # errors written to a worker's stderr are dropped otherwise
+        _log.warning('PHP_ERROR_LOG is stderr, enabling catch_workers_output')
+        print('WARNING: PHP_FPM_CATCH_WORKERS_OUTPUT is ignored, because '
+              'PHP_ERROR_LOG is stderr. Set PHP_ERROR_LOG to a path to '
+              'disable it.')
+        catch_output = True
+    ctx['PHP_FPM_CATCH_WORKERS_OUTPUT_CONF'] = 'catch_workers_output = %s' % (
+        catch_output and 'yes' or 'no')
+    exts = php_file_extensions(ctx)
+    if exts == ['php']:
+        ctx['PHP_FPM_LIMIT_EXTENSIONS_CONF'] = \
+            ';security.limit_extensions = .php .php3 .php4 .php5'
+    else:
+        ctx['PHP_FPM_LIMIT_EXTENSIONS_CONF'] = \
+            'security.limit_extensions = %s' % ' '.join(
+                '.%s' % ext for ext in exts)
+    status_path = fpm_status_path(ctx)
+    if status_path:
+        ctx['PHP_FPM_STATUS_CONF'] = 'pm.status_path = %s' % status_path
+    else:
+        ctx['PHP_FPM_STATUS_CONF'] = ';pm.status_path = /status'
+    ping_path = fpm_ping_path(ctx)
+    if ping_path:
+        response = str(ctx.get('PHP_FPM_PING_RESPONSE', 'pong') or 'pong')
+        if '\n' in response:
+            raise RuntimeError('PHP_FPM_PING_RESPONSE must be a single line, '
+                               'got [%s]' % response)
+        ctx['PHP_FPM_PING_PATH_CONF'] = 'ping.path = %s' % ping_path
+        ctx['PHP_FPM_PING_RESPONSE_CONF'] = 'ping.response = %s' % response
+    else:
+        ctx['PHP_FPM_PING_PATH_CONF'] = ';ping.path = /ping'
+        ctx['PHP_FPM_PING_RESPONSE_CONF'] = ';ping.response = pong'
+    ctx['PHP_FPM_CLEAR_ENV_CONF'] = 'clear_env = %s' % (
+        _is_enabled(ctx.get('PHP_FPM_CLEAR_ENV', False)) and 'yes' or 'no')
+    ctx['PHP_FPM_ENV_PASSTHROUGH_CONF'] = '\n'.join(
+        ['env[%s] = $%s' % (name, name)
+         for name in ctx.get('PHP_FPM_ENV_PASSTHROUGH', [])])
+    ctx['PHP_FPM_ADMIN_VALUES_CONF'] = verbatim(_php_admin_values(ctx))
+    ctx['PHP_FPM_DECORATE_WORKERS_OUTPUT_CONF'] = ''
+    decorate = ctx.get('PHP_FPM_DECORATE_WORKERS_OUTPUT')
+    if decorate is not None:
+        php_version = tuple(int(v) for v in ctx['PHP_VERSION'].split('.')[0:2])
+        if php_version >= (7, 3):
+            ctx['PHP_FPM_DECORATE_WORKERS_OUTPUT_CONF'] = \
+                'decorate_workers_output = %s' % (
+                    _is_enabled(decorate) and 'yes' or 'no')
+        else:
+            print('WARNING: PHP_FPM_DECORATE_WORKERS_OUTPUT requires PHP 7.3 '
+                  'or newer and will be ignored for PHP {}.'.format(
+                      ctx['PHP_VERSION']))
+
+
 def convert_php_extensions(ctx):
     _log.debug('Converting PHP extensions')
     SKIP = ('cli', 'pear', 'cgi')
-    ctx['PHP_EXTENSIONS'] = \
-        "\n".join(["extension=%s.so" % ex
-                   for ex in ctx['PHP_EXTENSIONS'] if ex not in SKIP])
-    path = ''
-    ctx['ZEND_EXTENSIONS'] = \
-        "\n".join(['zend_extension="%s"' % os.path.join(path, "%s.so" % ze)
-                   for ze in ctx['ZEND_EXTENSIONS']])
+    # these fail to load with `extension=`, however they were requested
+    zend_exts = list(ctx['ZEND_EXTENSIONS'])
+    for ex in ctx['PHP_EXTENSIONS']:
+        if ex.lower() in ZEND_ONLY_EXTENSIONS and ex not in zend_exts:
+            _log.debug('Loading [%s] as a zend_extension', ex)
+            zend_exts.append(ex)
+    # extensions from EXTENSION_DIRS are loaded by their full path
+    paths = 'EXTENSION_DIRS' in ctx and extension_dir_modules(ctx) or {}
+    php_exts = "\n".join(["extension=%s" % paths.get(ex, "%s.so" % ex)
+                          for ex in ctx['PHP_EXTENSIONS']
+                          if ex not in SKIP and
+                          ex.lower() not in ZEND_ONLY_EXTENSIONS])
+    zend_exts = "\n".join(['zend_extension="%s"' % paths.get(ze, "%s.so" % ze)
+                           for ze in zend_exts])
+    ctx['PHP_EXTENSIONS'] = paths and verbatim(php_exts) or php_exts
+    ctx['ZEND_EXTENSIONS'] = paths and verbatim(zend_exts) or zend_exts
+
+
+def write_extension_ini_files(ctx):
+    """Load the extensions in EXTENSION_PRIORITIES from php.ini.d files.
+
+    EXTENSION_PRIORITIES maps extension names to a number from 0 to 99,
+    which prefixes the file name, like `20-xdebug.ini`.  PHP reads these
+    after php.ini and in file name order, so lower numbers load first.
+    Run this before convert_php_extensions, it takes these extensions out
+    of PHP_EXTENSIONS and ZEND_EXTENSIONS.
+    """
+    priorities = ctx.get('EXTENSION_PRIORITIES', None) or {}
+    if not priorities:
+        return []
+    for name in priorities:
+        priority = priorities[name]
+        if not re.match(r'^\d{1,2}$', str(priority)):
+            raise RuntimeError('EXTENSION_PRIORITIES values must be numbers '
+                               'from 0 to 99, got [%s] for [%s]' % (
+                                   priority, name))
+    ini_d = os.path.join(ctx['BUILD_DIR'], 'php', 'etc', 'php.ini.d')
+    paths = extension_dir_modules(ctx)
+    written = []
+    for key, directive in (('PHP_EXTENSIONS', 'extension=%s'),
+                           ('ZEND_EXTENSIONS', 'zend_extension="%s"')):
+        remaining = []
+        for ex in ctx[key]:
+            if ex not in priorities:
+                remaining.append(ex)
+                continue
+            path = paths.get(ex, '%s.so' % ex)
+            if key == 'PHP_EXTENSIONS' and ex.lower() in ZEND_ONLY_EXTENSIONS:
+                line = 'zend_extension="%s"' % path
+            else:
+                line = directive % path
+            name = '%02d-%s.ini' % (int(priorities[ex]), ex)
+            utils.safe_makedirs(ini_d)
+            with open(os.path.join(ini_d, name), 'wt') as f:
+                f.write(line + '\n')
+            _log.debug('Loading [%s] from php.ini.d/%s', ex, name)
+            written.append(name)
+        ctx[key] = remaining
+    for name in priorities:
+        if '%02d-%s.ini' % (int(priorities[name]), name) not in written:
+            print('WARNING: EXTENSION_PRIORITIES lists [{}], which is not '
+                  'in PHP_EXTENSIONS or ZEND_EXTENSIONS.'.format(name))
+    return sorted(written)
 
 
 def is_web_app(ctx):
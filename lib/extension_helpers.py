@@ -35,10 +35,11 @@ class ExtensionHelper(object):
         if hasattr(module, 'strip'):
             import sys
             module = sys.modules[module]
-        # register four methods that take a ctx param
+        # register five methods that take a ctx param
         for method in ('configure',
                        'preprocess_commands',
                        'service_commands',
+                       'sidecar_commands',
                        'service_environment'):
             setattr(module, method, cls._make_helper(method))
 
@@ -109,6 +110,10 @@ class ExtensionHelper(object):
         """Return dict of commands to run x[name]=cmd"""
         return {}
 
+    def _sidecar_commands(self):
+        """Return dict of commands to run next to the web process"""
+        return {}
+
     def _service_environment(self):
         """Return dict of environment variables x[var]=val"""
         return {}
@@ -137,6 +142,14 @@ class ExtensionHelper(object):
         return (self._should_compile() and
                 self._service_commands() or {})
 
+    def sidecar_commands(self):
+        """Return dictionary of sidecar commands for the release YAML.
+
+        This method maps to the extension's `sidecar_commands` method.
+        """
+        return (self._should_compile() and
+                self._sidecar_commands() or {})
+
     def service_environment(self):
         """Return dictionary of environment for the service commands.
 
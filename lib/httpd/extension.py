@@ -12,6 +12,18 @@
 # WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 # See the License for the specific language governing permissions and
 # limitations under the License.
+import os
+import re
+import shutil
+import logging
+from build_pack_utils import utils
+from compile_helpers import request_terminate_timeout
+from compile_helpers import php_file_extensions
+from compile_helpers import php_output_buffering
+from compile_helpers import _is_enabled
+from compile_helpers import verbatim
+
+_log = logging.getLogger('httpd')
 
 
 def preprocess_commands(ctx):
@@ -20,13 +32,70 @@ def preprocess_commands(ctx):
         '"$HOME/httpd/conf"'),)
 
 
+def wait_for_php_fpm(ctx):
+    """Build a shell snippet which waits for PHP-FPM to accept connections.
+
+    Polls the FPM listener every 100ms until it is reachable or until
+    PHP_FPM_READY_TIMEOUT seconds (default 10) have elapsed, then warns
+    that httpd is started anyway.
+    """
+    host, port = ctx.get('PHP_FPM_LISTEN', '127.0.0.1:9000').rsplit(':', 1)
+    return ('i=0; while [ $i -lt $(( ${PHP_FPM_READY_TIMEOUT:-10} * 10 )) ] '
+            '&& ! $HOME/php/bin/php -n -r '
+            '\'exit(@fsockopen("%s", %s) ? 0 : 1);\'; '
+            'do i=$((i + 1)); sleep 0.1; done; '
+            '[ $i -lt $(( ${PHP_FPM_READY_TIMEOUT:-10} * 10 )) ] || '
+            'echo "WARNING: PHP-FPM did not accept connections within '
+            '${PHP_FPM_READY_TIMEOUT:-10}s, starting httpd anyway";'
+            % (host, port))
+
+
+def warmup_request(ctx):
+    """Build a shell snippet which requests WARMUP_URL once httpd is up.
+
+    It runs in the background, so httpd can be started with exec, and
+    failures are ignored.  With TLS, httpd only speaks https on $PORT, and
+    its certificate isn't for 127.0.0.1, so it isn't verified.
+    """
+    url = ctx.get('WARMUP_URL')
+    if not url:
+        return ''
+    if not re.match(r'^/[^\s\'"\\`${}]*$', url):
+        raise RuntimeError('WARMUP_URL must be a path like `/warmup`, '
+                           'got [%s]' % url)
+    (scheme, curl) = (ctx.get('TLS') and ('https', 'curl -k') or
+                      ('http', 'curl'))
+    return ('(i=0; while [ $i -lt 300 ] && '
+            '! %s -s -o /dev/null %s://127.0.0.1:$PORT/; '
+            'do i=$((i + 1)); sleep 0.1; done; '
+            '%s -s -o /dev/null -m 60 "%s://127.0.0.1:$PORT%s" '
+            '|| true) &' % (curl, scheme, curl, scheme, url))
+
+
+def start_order(ctx):
+    """Returns START_ORDER, `fpm-first` (the default) or `httpd-first`.
+
+    With `fpm-first` httpd waits for PHP-FPM before it starts.  With
+    `httpd-first` httpd binds the port right away and retries requests,
+    see setup_php_retry, until PHP-FPM accepts them.
+    """
+    order = ctx.get('START_ORDER', 'fpm-first')
+    if order not in ('fpm-first', 'httpd-first'):
+        raise RuntimeError('START_ORDER must be `fpm-first` or '
+                           '`httpd-first`, got [%s]' % order)
+    return order
+
+
 def service_commands(ctx):
     return {
-        'httpd': (
+        'httpd': tuple(filter(None, (
+            start_order(ctx) == 'fpm-first' and wait_for_php_fpm(ctx),
+            warmup_request(ctx),
+            'exec',
             '$HOME/httpd/bin/apachectl',
             '-f "$HOME/httpd/conf/httpd.conf"',
             '-k start',
-            '-DFOREGROUND')
+            '-DFOREGROUND')))
     }
 
 
@@ -36,13 +105,796 @@ def service_environment(ctx):
     }
 
 
+def setup_content_security_policy(ctx):
+    """Build the Content-Security-Policy header directive.
+
+    CONTENT_SECURITY_POLICY can be a string or a dict of directives to
+    their sources.  If CONTENT_SECURITY_POLICY_REPORT_ONLY is true, the
+    policy is sent with the report only header instead.
+    """
+    policy = ctx.get('CONTENT_SECURITY_POLICY', '')
+    if hasattr(policy, 'keys'):
+        directives = []
+        for name in sorted(policy.keys()):
+            sources = policy[name]
+            if not hasattr(sources, 'strip'):
+                sources = ' '.join(sources)
+            directives.append(('%s %s' % (name, sources)).strip())
+        policy = '; '.join(directives)
+    if not policy:
+        ctx['HTTPD_CONTENT_SECURITY_POLICY'] = ''
+        return
+    header = 'Content-Security-Policy'
+    if _is_enabled(ctx.get('CONTENT_SECURITY_POLICY_REPORT_ONLY', False)):
+        header = 'Content-Security-Policy-Report-Only'
+    ctx['HTTPD_CONTENT_SECURITY_POLICY'] = 'Header set %s "%s"' % (
+        header, policy.replace('"', '\\"'))
+
+
+STATIC_CACHE_GROUPS = (
+    ('images', ('gif', 'ico', 'jpe?g', 'png', 'svg', 'webp')),
+    ('css_js', ('css', 'js')),
+    ('fonts', ('eot', 'otf', 'ttf', 'woff2?'))
+)
+# short, so deploys are picked up quickly without cache busting
+STATIC_CACHE_CONTROL = {
+    'images': 3600,
+    'css_js': 300,
+    'fonts': 86400
+}
+
+
+def setup_static_cache_control(ctx):
+    """Build the Cache-Control headers for static assets.
+
+    STATIC_CACHE_CONTROL maps the groups in STATIC_CACHE_GROUPS to a
+    max-age in seconds.  Groups which aren't listed keep their default,
+    set a group to false to send no header for it, or set
+    STATIC_CACHE_CONTROL to false to send none at all.
+    """
+    configured = ctx.get('STATIC_CACHE_CONTROL', {})
+    if configured is False:
+        ctx['HTTPD_STATIC_CACHE_CONTROL'] = ''
+        return
+    groups = dict(STATIC_CACHE_GROUPS)
+    for name in (configured or {}):
+        if name not in groups:
+            raise RuntimeError('STATIC_CACHE_CONTROL groups must be one of '
+                               '[%s], got [%s]' % (
+                                   ', '.join(sorted(groups.keys())), name))
+    max_ages = dict(STATIC_CACHE_CONTROL)
+    max_ages.update(configured or {})
+    lines = []
+    for name, exts in STATIC_CACHE_GROUPS:
+        max_age = max_ages[name]
+        if max_age is None or max_age is False:
+            continue
+        if not re.match(r'^\d+$', str(max_age)):
+            raise RuntimeError('STATIC_CACHE_CONTROL max-age must be a '
+                               'non-negative integer, got [%s]' % max_age)
+        lines.extend([
+            '<FilesMatch "\\.(%s)$">' % '|'.join(exts),
+            '    Header set Cache-Control "public, max-age=%d"' %
+            int(max_age),
+            '</FilesMatch>'])
+    ctx['HTTPD_STATIC_CACHE_CONTROL'] = '\n'.join(lines)
+
+
+# Mozilla's intermediate configuration, TLS is usually terminated by the
+# router, so this is only used when TLS is set
+TLS_DEFAULTS = {
+    'protocols': ['-all', '+TLSv1.2'],
+    'ciphers': 'ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:'
+               'ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:'
+               'ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305'
+}
+
+
+def _tls_file(ctx, tls, key):
+    path = tls.get(key)
+    if not path or not hasattr(path, 'strip') or '"' in path or \
+            os.path.isabs(path) or path.startswith('..'):
+        raise RuntimeError('TLS %s must be the path of a file in the app, '
+                           'got [%s]' % (key, path))
+    if not os.path.isfile(os.path.join(ctx['BUILD_DIR'], path)):
+        raise RuntimeError('TLS %s [%s] does not exist in the app' % (key,
+                                                                      path))
+    return '${HOME}/%s' % path
+
+
+def setup_tls(ctx):
+    """Serve the app over TLS with mod_ssl, when TLS is set.
+
+    TLS has `cert` and `key`, the paths of the PEM files in the app, and
+    optional `protocols` and `ciphers`, which default to TLS_DEFAULTS.
+    """
+    tls = ctx.get('TLS')
+    if not tls:
+        ctx['HTTPD_TLS'] = ''
+        return
+    if not hasattr(tls, 'get'):
+        raise RuntimeError('TLS must be an object, got [%s]' % tls)
+    cert = _tls_file(ctx, tls, 'cert')
+    key = _tls_file(ctx, tls, 'key')
+    protocols = tls.get('protocols') or TLS_DEFAULTS['protocols']
+    if not hasattr(protocols, 'strip'):
+        protocols = ' '.join(protocols)
+    if not re.match(r'^[-+]?[A-Za-z0-9.]+( [-+]?[A-Za-z0-9.]+)*$',
+                    protocols):
+        raise RuntimeError('TLS protocols must be SSLProtocol values like '
+                           '`+TLSv1.2`, got [%s]' % protocols)
+    ciphers = tls.get('ciphers') or TLS_DEFAULTS['ciphers']
+    if not re.match(r'^[A-Za-z0-9_:!+@=.-]+$', ciphers):
+        raise RuntimeError('TLS ciphers must be an OpenSSL cipher list, '
+                           'got [%s]' % ciphers)
+    ctx['HTTPD_TLS'] = verbatim([
+        '<IfModule !mod_ssl.c>',
+        '  LoadModule ssl_module modules/mod_ssl.so',
+        '</IfModule>',
+        'SSLEngine on',
+        'SSLCertificateFile "%s"' % cert,
+        'SSLCertificateKeyFile "%s"' % key,
+        'SSLProtocol %s' % protocols,
+        'SSLCipherSuite %s' % ciphers,
+        'SSLHonorCipherOrder off'])
+
+
+def setup_request_id(ctx):
+    """Build the directives which propagate a request id to PHP.
+
+    When REQUEST_ID_HEADER is enabled, a request id is generated with
+    mod_unique_id for requests without one.  The header is passed to
+    PHP-FPM (as HTTP_X_REQUEST_ID) and echoed back in the response.
+    REQUEST_ID_HEADER can be true, to use `X-Request-Id`, or the name
+    of the header to use.
+    """
+    header = ctx.get('REQUEST_ID_HEADER', False)
+    if not header:
+        ctx['HTTPD_REQUEST_ID'] = ''
+        return
+    if not hasattr(header, 'strip'):
+        header = 'X-Request-Id'
+    ctx['HTTPD_REQUEST_ID'] = verbatim([
+        '<IfModule !mod_unique_id.c>',
+        '  LoadModule unique_id_module modules/mod_unique_id.so',
+        '</IfModule>',
+        'RequestHeader setifempty %s "%%{UNIQUE_ID}e"' % header,
+        'Header always set %s "%%{%s}i"' % (header, header)])
+
+
+def base_path(ctx):
+    """Returns BASE_PATH without a trailing slash, '' when at the root"""
+    path = ctx.get('BASE_PATH', '') or ''
+    path = path.rstrip('/')
+    if path and not re.match(r'^(/[A-Za-z0-9._~-]+)+$', path):
+        raise RuntimeError('BASE_PATH must be a URL path like `/myapp`, '
+                           'got [%s]' % ctx.get('BASE_PATH'))
+    return path
+
+
+def setup_base_path(ctx):
+    """Serve the app under BASE_PATH and tell PHP about it.
+
+    The path is passed to PHP as the BASE_PATH FastCGI param, so apps can
+    use it when building URLs.
+    """
+    path = base_path(ctx)
+    if not path:
+        ctx['HTTPD_BASE_PATH'] = ''
+        return
+    ctx['HTTPD_BASE_PATH'] = verbatim([
+        '<IfModule !mod_alias.c>',
+        '  LoadModule alias_module modules/mod_alias.so',
+        '</IfModule>',
+        'Alias "%s" "${HOME}/%s"' % (path, ctx['WEBDIR']),
+        'SetEnv BASE_PATH "%s"' % path])
+
+
+FAVICON_TYPES = {
+    '.ico': 'image/x-icon',
+    '.png': 'image/png',
+    '.gif': 'image/gif',
+    '.svg': 'image/svg+xml'
+}
+
+
+def _static_asset(ctx, key, name, inline=False):
+    """Copy an asset under `.bp/static`, returns the copy's relative path.
+
+    The value of `key` is a file relative to the app root or, when
+    `inline` is allowed, the content itself.
+    """
+    source = ctx.get(key, format=False)
+    static_dir = os.path.join(ctx['BUILD_DIR'], '.bp', 'static')
+    utils.safe_makedirs(static_dir)
+    path = os.path.join(ctx['BUILD_DIR'], source.lstrip('/'))
+    if os.path.isfile(path):
+        shutil.copy(path, os.path.join(static_dir, name))
+    elif inline:
+        with open(os.path.join(static_dir, name), 'wt') as fp:
+            fp.write(source)
+    else:
+        raise RuntimeError('%s must be a file in the application, '
+                           'got [%s]' % (key, source))
+    return '.bp/static/%s' % name
+
+
+def setup_static_assets(ctx):
+    """Serve /robots.txt and /favicon.ico without going to PHP.
+
+    ROBOTS_TXT is a file in the app or the content of robots.txt and
+    FAVICON is an image file in the app.  Without a FAVICON, and with no
+    favicon.ico in WEBDIR, /favicon.ico gets an empty 204.
+    """
+    assets = []
+    robots = ctx.get('ROBOTS_TXT')
+    if robots:
+        assets.append(('/robots.txt',
+                       _static_asset(ctx, 'ROBOTS_TXT', 'robots.txt',
+                                     inline=True),
+                       'text/plain'))
+    favicon = ctx.get('FAVICON')
+    if favicon:
+        ext = os.path.splitext(favicon)[1].lower()
+        if ext not in FAVICON_TYPES:
+            raise RuntimeError('FAVICON must be one of %s, got [%s]' % (
+                ', '.join(sorted(FAVICON_TYPES.keys())), favicon))
+        assets.append(('/favicon.ico',
+                       _static_asset(ctx, 'FAVICON', 'favicon%s' % ext),
+                       FAVICON_TYPES[ext]))
+    no_favicon = not favicon and not os.path.exists(
+        os.path.join(ctx['BUILD_DIR'], ctx['WEBDIR'], 'favicon.ico'))
+    if not assets and not no_favicon:
+        ctx['HTTPD_STATIC_ASSETS'] = ''
+        return
+    lines = ['<IfModule !mod_alias.c>',
+             '  LoadModule alias_module modules/mod_alias.so',
+             '</IfModule>']
+    if no_favicon:
+        lines.append('Redirect 204 /favicon.ico')
+    for url, path, content_type in assets:
+        lines.extend(['Alias "%s" "${HOME}/%s"' % (url, path),
+                      '<Location "%s">' % url,
+                      '    ForceType %s' % content_type,
+                      '</Location>'])
+    if assets:
+        lines.extend(['<Directory "${HOME}/.bp/static">',
+                      '    Require all granted',
+                      '</Directory>'])
+    ctx['HTTPD_STATIC_ASSETS'] = verbatim(lines)
+
+
+def setup_php_files_match(ctx):
+    """Send files with any of the PHP_FILE_EXTENSIONS to PHP-FPM"""
+    ctx['HTTPD_PHP_FILES_MATCH'] = \
+        '\\.(%s)$' % '|'.join(php_file_extensions(ctx))
+
+
+def setup_php_retry(ctx):
+    """Retry requests PHP-FPM refuses, when RETRY_ON_FPM_ERROR is set.
+
+    FPM is put behind a one member balancer, which tries it up to three
+    times.  This hides brief errors while FPM restarts workers, at the
+    cost of a slower error when FPM is really down.  It is always on with
+    the `httpd-first` START_ORDER, which sends requests before FPM is up.
+    """
+    if not _is_enabled(ctx.get('RETRY_ON_FPM_ERROR', False)) and \
+            start_order(ctx) == 'fpm-first':
+        ctx['HTTPD_PHP_HANDLER'] = 'proxy:fcgi://%s' % ctx['PHP_FPM_LISTEN']
+        ctx['HTTPD_PHP_RETRY'] = ''
+        return
+    ctx['HTTPD_PHP_HANDLER'] = 'proxy:balancer://php-fpm'
+    lines = []
+    for module in ('slotmem_shm', 'proxy_balancer', 'lbmethod_byrequests'):
+        lines.extend(['<IfModule !mod_%s.c>' % module,
+                      '  LoadModule %s_module modules/mod_%s.so' % (module,
+                                                                   module),
+                      '</IfModule>'])
+    lines.extend([
+        '<Proxy "balancer://php-fpm">',
+        '    BalancerMember "fcgi://%s" retry=0 disablereuse=On%s' % (
+            ctx['PHP_FPM_LISTEN'],
+            _proxy_flush_packets(ctx) == 'on' and ' flushpackets=on' or ''),
+        '    ProxySet maxattempts=3 failonstatus=503 forcerecovery=On',
+        '</Proxy>'])
+    ctx['HTTPD_PHP_RETRY'] = '\n'.join(lines)
+
+
+def _proxy_flush_packets(ctx):
+    return php_output_buffering(ctx) == 'Off' and 'on' or 'off'
+
+
+def setup_php_proxy_flush(ctx):
+    """Send PHP's output on right away, when PHP_OUTPUT_BUFFERING is off.
+
+    Otherwise Apache buffers it and streamed responses arrive in chunks.
+    """
+    ctx['HTTPD_PROXY_FLUSH_PACKETS'] = _proxy_flush_packets(ctx)
+
+
+def setup_proxy_error_override(ctx):
+    """Set ProxyErrorOverride from PROXY_ERROR_OVERRIDE, off by default.
+
+    Off, error responses from PHP reach the client as the app made them.
+    On, Apache replaces them with its own error page, or an ErrorDocument
+    from the app's httpd config.
+    """
+    ctx['HTTPD_PROXY_ERROR_OVERRIDE'] = \
+        _is_enabled(ctx.get('PROXY_ERROR_OVERRIDE', False)) and 'On' or 'Off'
+
+
+def setup_directory_listing(ctx):
+    """Turn off directory listings, unless ALLOW_DIRECTORY_LISTING is set"""
+    if not _is_enabled(ctx.get('ALLOW_DIRECTORY_LISTING', False)):
+        ctx['HTTPD_AUTOINDEX_MODULE'] = ''
+        ctx['HTTPD_DIRECTORY_LISTING'] = '-Indexes'
+        return
+    ctx['HTTPD_AUTOINDEX_MODULE'] = '\n'.join([
+        '<IfModule !mod_autoindex.c>',
+        '  LoadModule autoindex_module modules/mod_autoindex.so',
+        '</IfModule>'])
+    ctx['HTTPD_DIRECTORY_LISTING'] = '+Indexes'
+
+
+HTACCESS_OVERRIDES = ('AuthConfig', 'FileInfo', 'Indexes', 'Limit',
+                      'Options')
+
+
+def setup_allow_override(ctx):
+    """Set which .htaccess directives apply in the webdir.
+
+    ALLOW_HTACCESS can be true, for `All`, false, for `None`, or a list
+    of HTACCESS_OVERRIDES.  It's `None` by default, so .htaccess files in
+    the app are ignored unless they're enabled explicitly.
+    """
+    allow = ctx.get('ALLOW_HTACCESS', False)
+    if hasattr(allow, 'lower') and \
+            allow.lower() in ('yes', 'true', 'on', '1', 'no', 'false', 'off',
+                              '0', ''):
+        allow = _is_enabled(allow)
+    if allow is True or allow is False:
+        ctx['HTTPD_ALLOW_OVERRIDE'] = allow and 'All' or 'None'
+    else:
+        if hasattr(allow, 'strip'):
+            allow = allow.split()
+        for name in allow:
+            if name not in HTACCESS_OVERRIDES:
+                raise RuntimeError('ALLOW_HTACCESS must be true, false or a '
+                                   'list of [%s], got [%s]' % (
+                                       ', '.join(HTACCESS_OVERRIDES), name))
+        ctx['HTTPD_ALLOW_OVERRIDE'] = ' '.join(allow) or 'None'
+    if ctx['HTTPD_ALLOW_OVERRIDE'] != 'None':
+        msg = ('ALLOW_HTACCESS is set, so Apache checks every directory on '
+               'the request path for .htaccess files. Move the rules to '
+               '.bp-config/httpd for better performance.')
+        _log.warning(msg)
+        print 'WARNING: %s' % msg
+
+
+def setup_fallback_resource(ctx):
+    """Route requests which don't match a file to the front controller.
+
+    FALLBACK_TO_FRONT_CONTROLLER can be true, to use `/index.php`, or
+    the path of the front controller.
+    """
+    fallback = ctx.get('FALLBACK_TO_FRONT_CONTROLLER', False)
+    if not fallback:
+        ctx['HTTPD_FALLBACK_RESOURCE'] = ''
+        return
+    if not hasattr(fallback, 'strip'):
+        fallback = '/index.php'
+    if fallback.startswith('/'):
+        fallback = base_path(ctx) + fallback
+    ctx['HTTPD_FALLBACK_RESOURCE'] = 'FallbackResource %s' % fallback
+
+
+DIRECTORY_INDEX = ('index.php', 'index.html', 'index.htm')
+FRONT_CONTROLLERS = ('index.php', 'app.php')
+
+
+def front_controller(ctx):
+    """Returns the file name of the front controller in the webdir.
+
+    FRONT_CONTROLLER wins, then a FALLBACK_TO_FRONT_CONTROLLER path, then
+    the first of FRONT_CONTROLLERS found in the webdir.
+    """
+    controller = ctx.get('FRONT_CONTROLLER', None)
+    if not controller:
+        fallback = ctx.get('FALLBACK_TO_FRONT_CONTROLLER', False)
+        if hasattr(fallback, 'strip'):
+            controller = fallback
+    if not controller:
+        webdir = os.path.join(ctx.get('BUILD_DIR', ''), ctx['WEBDIR'])
+        for name in FRONT_CONTROLLERS:
+            if os.path.isfile(os.path.join(webdir, name)):
+                return name
+        return DIRECTORY_INDEX[0]
+    controller = controller.lstrip('/')
+    if not re.match(r'^[A-Za-z0-9_.\-]+$', controller):
+        raise RuntimeError('FRONT_CONTROLLER must be a file name in the '
+                           'webdir, got [%s]' % controller)
+    return controller
+
+
+def setup_directory_index(ctx):
+    """List the front controller first in DirectoryIndex, so `/` is
+    served by it in apps without an index.html"""
+    controller = front_controller(ctx)
+    names = [controller] + [name for name in DIRECTORY_INDEX
+                            if name != controller]
+    ctx['HTTPD_DIRECTORY_INDEX'] = ' '.join(names)
+
+
+def _rewrite_arg(arg):
+    if ' ' in arg or '\t' in arg:
+        return '"%s"' % arg.replace('"', '\\"')
+    return arg
+
+
+def setup_rewrite_rules(ctx):
+    """Build the RewriteRule directives from REWRITE_RULES.
+
+    REWRITE_RULES is a list of dicts with `from`, `to` and optional
+    `flags` keys.  Rules are written in the order they are listed.
+    """
+    rules = ctx.get('REWRITE_RULES', [])
+    if not rules:
+        ctx['HTTPD_REWRITE_RULES'] = ''
+        return
+    lines = ['RewriteEngine On']
+    for rule in rules:
+        if 'from' not in rule or 'to' not in rule:
+            raise RuntimeError('Each of REWRITE_RULES must have a `from` '
+                               'and a `to`, got %s' % rule)
+        line = 'RewriteRule %s %s' % (_rewrite_arg(rule['from']),
+                                      _rewrite_arg(rule['to']))
+        flags = rule.get('flags')
+        if flags:
+            if not hasattr(flags, 'strip'):
+                flags = ','.join(flags)
+            line += ' [%s]' % flags.strip('[]')
+        lines.append(line)
+    ctx['HTTPD_REWRITE_RULES'] = verbatim(lines)
+
+
+def setup_trailing_slash(ctx):
+    """Redirect URLs to a consistent trailing slash, with TRAILING_SLASH.
+
+    `preserve`, the default, leaves URLs alone.  `add` redirects paths
+    without a slash and `remove` redirects paths with one.  Files and the
+    front controller, which may have path info after it, are left alone.
+    """
+    policy = ctx.get('TRAILING_SLASH', 'preserve') or 'preserve'
+    if policy not in ('preserve', 'add', 'remove'):
+        raise RuntimeError('TRAILING_SLASH must be one of `preserve`, `add` '
+                           'or `remove`, got [%s]' % policy)
+    if policy == 'preserve':
+        ctx['HTTPD_TRAILING_SLASH'] = ''
+        return
+    controller = '%s/%s' % (base_path(ctx), front_controller(ctx))
+    lines = ['RewriteEngine On',
+             'RewriteCond %%{REQUEST_URI} !^%s(/|$)' %
+             controller.replace('.', '\\.')]
+    if policy == 'add':
+        lines.extend([
+            'RewriteCond %{DOCUMENT_ROOT}%{REQUEST_URI} !-f',
+            'RewriteCond %{REQUEST_URI} !\\.[A-Za-z0-9]+$',
+            'RewriteRule ^(.*[^/])$ $1/ [R=301,L]'])
+    else:
+        lines.extend([
+            'RewriteCond %{DOCUMENT_ROOT}%{REQUEST_URI} !-d',
+            'RewriteRule ^(.+)/$ $1 [R=301,L]'])
+    ctx['HTTPD_TRAILING_SLASH'] = verbatim(lines)
+
+
+def setup_allowed_methods(ctx):
+    """Answer requests using methods not in ALLOWED_METHODS with a 405.
+
+    TRACE is disabled, unless it's one of the ALLOWED_METHODS.
+    """
+    methods = [m.upper() for m in ctx.get('ALLOWED_METHODS', [])]
+    for method in methods:
+        if not re.match(r'^[A-Z]+$', method):
+            raise RuntimeError('ALLOWED_METHODS must be HTTP method names, '
+                               'got [%s]' % method)
+    ctx['HTTPD_TRACE_ENABLE'] = 'TRACE' in methods and 'on' or 'off'
+    if not methods:
+        ctx['HTTPD_ALLOWED_METHODS'] = ''
+        return
+    ctx['HTTPD_ALLOWED_METHODS'] = verbatim([
+        'RewriteEngine On',
+        'RewriteCond %%{REQUEST_METHOD} !^(%s)$' % '|'.join(methods),
+        'RewriteRule .* - [R=405,L]'])
+
+
+def setup_remote_ip(ctx):
+    """Take the client IP from REAL_IP_HEADER, set by trusted proxies.
+
+    By default the private networks, where the CF router runs, are
+    trusted.  REAL_IP_TRUSTED_PROXIES replaces them with a list of
+    addresses or CIDR ranges.
+    """
+    header = ctx.get('REAL_IP_HEADER') or 'X-Forwarded-For'
+    if not re.match(r'^[A-Za-z0-9-]+$', header):
+        raise RuntimeError('REAL_IP_HEADER must be an HTTP header name, '
+                           'got [%s]' % header)
+    ctx['HTTPD_REMOTE_IP_HEADER'] = header
+    proxies = ctx.get('REAL_IP_TRUSTED_PROXIES', [])
+    for proxy in proxies:
+        if not re.match(r'^[0-9A-Fa-f:.]+(/\d+)?$', proxy):
+            raise RuntimeError('REAL_IP_TRUSTED_PROXIES must be IP addresses '
+                               'or CIDR ranges, got [%s]' % proxy)
+    if proxies:
+        ctx['HTTPD_REMOTE_IP_PROXIES'] = \
+            'RemoteIPTrustedProxy %s' % ' '.join(proxies)
+    else:
+        ctx['HTTPD_REMOTE_IP_PROXIES'] = \
+            'RemoteIpInternalProxy 10.0.0.0/8 172.16.0.0/12 192.168.0.0/16'
+
+
+def setup_access_log_exclude(ctx):
+    """Build SetEnvIf directives marking requests to ACCESS_LOG_EXCLUDE
+    paths with `dontlog`, so they are left out of the access log."""
+    ctx['HTTPD_ACCESS_LOG_EXCLUDE'] = verbatim('\n    '.join(
+        ['SetEnvIf Request_URI "^%s$" dontlog' %
+         re.sub(r'([.^$*+?()\[\]{}|\\])', r'\\\1', path)
+         for path in ctx.get('ACCESS_LOG_EXCLUDE', [])]))
+
+
+# the LogFormat nicknames defined in httpd-logging.conf
+ACCESS_LOG_PRESETS = ('combined', 'common', 'extended', 'json')
+
+
+def setup_access_log_format(ctx):
+    """Pick the access log's LogFormat with ACCESS_LOG_PRESET.
+
+    `json` writes one JSON object per request, the default is `extended`.
+    """
+    preset = ctx.get('ACCESS_LOG_PRESET') or 'extended'
+    if preset not in ACCESS_LOG_PRESETS:
+        raise RuntimeError('ACCESS_LOG_PRESET must be one of %s, got [%s]' %
+                           (', '.join(ACCESS_LOG_PRESETS), preset))
+    ctx['HTTPD_ACCESS_LOG_FORMAT'] = preset
+
+
+def setup_start_servers(ctx):
+    """Validate HTTPD_START_SERVERS, the child processes started with httpd.
+
+    The MPM config allows 400 workers at 25 threads per child, so no more
+    than 16 children can run.
+    """
+    start = ctx.get('HTTPD_START_SERVERS', 3)
+    if not re.match(r'^\d+$', str(start)) or not 1 <= int(start) <= 16:
+        raise RuntimeError('HTTPD_START_SERVERS must be an integer between '
+                           '1 and 16, got [%s]' % start)
+    ctx['HTTPD_START_SERVERS'] = int(start)
+
+
+# the MaxRequestWorkers in httpd-mpm.conf and the httpd ServerLimit and
+# ThreadLimit defaults
+HTTPD_MAX_REQUEST_WORKERS = 400
+HTTPD_SERVER_LIMIT = 16
+HTTPD_THREAD_LIMIT = 64
+
+
+def setup_threads_per_child(ctx):
+    """Validate HTTPD_THREADS_PER_CHILD, the threads in each child process.
+
+    Returns warnings for combinations httpd will adjust at startup, which
+    are also printed.
+    """
+    threads = ctx.get('HTTPD_THREADS_PER_CHILD', 25)
+    if not re.match(r'^\d+$', str(threads)) or int(threads) < 1:
+        raise RuntimeError('HTTPD_THREADS_PER_CHILD must be a positive '
+                           'integer, got [%s]' % threads)
+    threads = ctx['HTTPD_THREADS_PER_CHILD'] = int(threads)
+    warnings = []
+    if threads > HTTPD_THREAD_LIMIT:
+        warnings.append(
+            'HTTPD_THREADS_PER_CHILD is %d, but httpd allows at most %d. '
+            'httpd will use %d.' % (threads, HTTPD_THREAD_LIMIT,
+                                    HTTPD_THREAD_LIMIT))
+    elif HTTPD_MAX_REQUEST_WORKERS > threads * HTTPD_SERVER_LIMIT:
+        warnings.append(
+            'HTTPD_THREADS_PER_CHILD is %d, so at most %d children serve %d '
+            'requests at once, not MaxRequestWorkers %d.' % (
+                threads, HTTPD_SERVER_LIMIT, threads * HTTPD_SERVER_LIMIT,
+                HTTPD_MAX_REQUEST_WORKERS))
+    elif HTTPD_MAX_REQUEST_WORKERS % threads:
+        warnings.append(
+            'MaxRequestWorkers %d is not a multiple of '
+            'HTTPD_THREADS_PER_CHILD %d, httpd will round it down.' % (
+                HTTPD_MAX_REQUEST_WORKERS, threads))
+    start = int(ctx.get('HTTPD_START_SERVERS', 3))
+    if start * min(threads, HTTPD_THREAD_LIMIT) > HTTPD_MAX_REQUEST_WORKERS:
+        warnings.append(
+            'HTTPD_START_SERVERS %d with HTTPD_THREADS_PER_CHILD %d starts '
+            'more threads than MaxRequestWorkers %d.' % (
+                start, threads, HTTPD_MAX_REQUEST_WORKERS))
+    for msg in warnings:
+        _log.warning(msg)
+        print 'WARNING: %s' % msg
+    return warnings
+
+
+def _rate_limit_int(limit, key, default=None):
+    val = limit.get(key, default)
+    if not re.match(r'^\d+$', str(val)):
+        raise RuntimeError('RATE_LIMIT %s must be a non-negative integer, '
+                           'got [%s]' % (key, val))
+    return int(val)
+
+
+def setup_rate_limit(ctx):
+    """Limit the requests per second from each client IP.
+
+    RATE_LIMIT has `requests_per_second`, and optional `burst` and
+    `block_seconds` keys.  It's applied with mod_evasive or mod_qos,
+    whichever the installed httpd has, so this runs after httpd is
+    installed.
+    """
+    ctx['HTTPD_RATE_LIMIT'] = ''
+    limit = ctx.get('RATE_LIMIT')
+    if not limit:
+        return
+    if not hasattr(limit, 'get'):
+        raise RuntimeError('RATE_LIMIT must be an object, got [%s]' % limit)
+    rps = _rate_limit_int(limit, 'requests_per_second')
+    if rps == 0:
+        raise RuntimeError('RATE_LIMIT requests_per_second must be '
+                           'greater than 0')
+    count = rps + _rate_limit_int(limit, 'burst', 0)
+    block = _rate_limit_int(limit, 'block_seconds', 10)
+    modules = os.path.join(ctx['BUILD_DIR'], 'httpd', 'modules')
+    if os.path.exists(os.path.join(modules, 'mod_evasive24.so')):
+        lines = ['<IfModule !mod_evasive24.c>',
+                 '  LoadModule evasive20_module modules/mod_evasive24.so',
+                 '</IfModule>',
+                 'DOSPageCount %d' % count,
+                 'DOSPageInterval 1',
+                 'DOSSiteCount %d' % count,
+                 'DOSSiteInterval 1',
+                 'DOSBlockingPeriod %d' % block]
+    elif os.path.exists(os.path.join(modules, 'mod_qos.so')):
+        lines = ['<IfModule !mod_qos.c>',
+                 '  LoadModule qos_module modules/mod_qos.so',
+                 '</IfModule>',
+                 'SetEnvIf Request_URI ^ QS_Limit=yes',
+                 'QS_ClientEventLimitCount %d 1' % count]
+    else:
+        msg = ('RATE_LIMIT is set, but the installed httpd has neither '
+               'mod_evasive nor mod_qos. Requests will not be rate limited.')
+        _log.warning(msg)
+        print 'WARNING: %s' % msg
+        return
+    ctx['HTTPD_RATE_LIMIT'] = '\n'.join(lines)
+
+
+def setup_allow_encoded_slashes(ctx):
+    """Set AllowEncodedSlashes from ALLOW_ENCODED_SLASHES.
+
+    Apache's default, `off`, rejects URLs with %2F in the path with a 404.
+    `on` decodes them and `nodecode` passes them to PHP as they are.
+    """
+    value = ctx.get('ALLOW_ENCODED_SLASHES', 'off')
+    if value is True or value is False:
+        value = value and 'on' or 'off'
+    values = {'on': 'On', 'off': 'Off', 'nodecode': 'NoDecode'}
+    if str(value).lower() not in values:
+        raise RuntimeError('ALLOW_ENCODED_SLASHES must be one of `on`, '
+                           '`off` or `nodecode`, got [%s]' % value)
+    ctx['HTTPD_ALLOW_ENCODED_SLASHES'] = values[str(value).lower()]
+
+
+def setup_limit_request_field_size(ctx):
+    """Validate HTTPD_LIMIT_REQUEST_FIELD_SIZE, the largest request header
+    httpd accepts in bytes.  Apache's default of 8190 is too small for some
+    large cookies or JWTs, which are rejected with a 400."""
+    size = ctx.get('HTTPD_LIMIT_REQUEST_FIELD_SIZE', 8190)
+    if not re.match(r'^[1-9]\d*$', str(size)):
+        raise RuntimeError('HTTPD_LIMIT_REQUEST_FIELD_SIZE must be a positive '
+                           'integer, got [%s]' % size)
+    ctx['HTTPD_LIMIT_REQUEST_FIELD_SIZE'] = int(size)
+
+
+DEFLATE_TYPES = ('text/html', 'text/plain', 'text/xml', 'text/css',
+                 'text/javascript', 'application/javascript')
+
+
+def setup_deflate(ctx):
+    """Configure mod_deflate from DEFLATE_MIN_LENGTH and
+    DEFLATE_COMPRESSION_LEVEL.
+
+    With a minimum length, responses with a smaller Content-Length are sent
+    uncompressed.  Responses without one, like most PHP output, are always
+    compressed, because Apache can't know their size up front.
+    """
+    level = ctx.get('DEFLATE_COMPRESSION_LEVEL', 6)
+    if not re.match(r'^[1-9]$', str(level)):
+        raise RuntimeError('DEFLATE_COMPRESSION_LEVEL must be between 1 and '
+                           '9, got [%s]' % level)
+    length = ctx.get('DEFLATE_MIN_LENGTH', 0)
+    if not re.match(r'^\d+$', str(length)):
+        raise RuntimeError('DEFLATE_MIN_LENGTH must be a number of bytes, '
+                           'got [%s]' % length)
+    ctx['HTTPD_DEFLATE_COMPRESSION_LEVEL'] = int(level)
+    if int(length) == 0:
+        ctx['HTTPD_DEFLATE_FILTER'] = \
+            'AddOutputFilterByType DEFLATE %s' % ' '.join(DEFLATE_TYPES)
+        return
+    ctx['HTTPD_DEFLATE_FILTER'] = verbatim((
+        'FilterDeclare COMPRESS CONTENT_SET',
+        'FilterProvider COMPRESS DEFLATE "%%{CONTENT_TYPE} =~ m#^(%s)# && '
+        '(-z resp(\'Content-Length\') || '
+        'resp(\'Content-Length\') -ge %d)"' % ('|'.join(DEFLATE_TYPES),
+                                                int(length)),
+        'FilterProtocol COMPRESS DEFLATE change=yes;byteranges=no',
+        'FilterChain COMPRESS'))
+
+
+def setup_timeout(ctx):
+    """Set Apache's Timeout a little longer than FPM's terminate timeout.
+
+    This way FPM ends a slow request before Apache gives up on it.  An
+    explicit HTTPD_TIMEOUT is kept, but a warning is shown when Apache
+    would give up first.  Without PHP_FPM_REQUEST_TERMINATE_TIMEOUT,
+    Apache's Timeout is left at 60s.
+    """
+    terminate = request_terminate_timeout(ctx)
+    if 'HTTPD_TIMEOUT' not in ctx:
+        ctx['HTTPD_TIMEOUT'] = terminate and terminate + 5 or 60
+        return
+    timeout = ctx['HTTPD_TIMEOUT']
+    if not re.match(r'^[1-9]\d*$', str(timeout)):
+        raise RuntimeError('HTTPD_TIMEOUT must be a positive integer, '
+                           'got [%s]' % timeout)
+    ctx['HTTPD_TIMEOUT'] = int(timeout)
+    if terminate is None:
+        return
+    if terminate == 0 or ctx['HTTPD_TIMEOUT'] <= terminate:
+        msg = ('HTTPD_TIMEOUT (%ss) should be longer than '
+               'PHP_FPM_REQUEST_TERMINATE_TIMEOUT (%s), or Apache gives up '
+               'on requests which PHP-FPM is still running.' % (
+                   ctx['HTTPD_TIMEOUT'],
+                   terminate and '%ss' % terminate or 'no limit'))
+        _log.warning(msg)
+        print 'WARNING: %s' % msg
+
+
 def compile(install):
     print 'Installing HTTPD'
     print 'HTTPD %s' % (install.builder._ctx['HTTPD_VERSION'])
 
     install.builder._ctx['PHP_FPM_LISTEN'] = '127.0.0.1:9000'
+    setup_content_security_policy(install.builder._ctx)
+    setup_request_id(install.builder._ctx)
+    setup_static_cache_control(install.builder._ctx)
+    setup_allowed_methods(install.builder._ctx)
+    setup_rewrite_rules(install.builder._ctx)
+    setup_trailing_slash(install.builder._ctx)
+    setup_base_path(install.builder._ctx)
+    setup_fallback_resource(install.builder._ctx)
+    setup_directory_listing(install.builder._ctx)
+    setup_allow_override(install.builder._ctx)
+    setup_directory_index(install.builder._ctx)
+    setup_php_files_match(install.builder._ctx)
+    setup_php_proxy_flush(install.builder._ctx)
+    setup_php_retry(install.builder._ctx)
+    setup_proxy_error_override(install.builder._ctx)
+    setup_static_assets(install.builder._ctx)
+    setup_remote_ip(install.builder._ctx)
+    setup_tls(install.builder._ctx)
+    setup_access_log_exclude(install.builder._ctx)
+    setup_access_log_format(install.builder._ctx)
+    setup_timeout(install.builder._ctx)
+    setup_allow_encoded_slashes(install.builder._ctx)
+    setup_limit_request_field_size(install.builder._ctx)
+    setup_deflate(install.builder._ctx)
+    setup_start_servers(install.builder._ctx)
+    setup_threads_per_child(install.builder._ctx)
+    install.package('HTTPD')
+    setup_rate_limit(install.builder._ctx)
     (install
-        .package('HTTPD')
         .config()
             .from_application('.bp-config/httpd')  # noqa
             .or_from_build_pack('defaults/config/httpd')
@@ -12,6 +12,7 @@
 # WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 # See the License for the specific language governing permissions and
 # limitations under the License.
+from compile_helpers import php_file_extensions
 
 
 def preprocess_commands(ctx):
@@ -35,6 +36,8 @@ def service_environment(ctx):
 def compile(install):
     print 'Installing Nginx'
     install.builder._ctx['PHP_FPM_LISTEN'] = '{TMPDIR}/php-fpm.socket'
+    install.builder._ctx['NGINX_PHP_LOCATION_MATCH'] = \
+        '.*\\.(%s)$' % '|'.join(php_file_extensions(install.builder._ctx))
     (install
         .package('NGINX')
         .config()
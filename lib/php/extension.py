@@ -13,19 +13,41 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 import os
+import re
 import string
 import json
 import glob
 from build_pack_utils import utils
 from compile_helpers import convert_php_extensions
+from compile_helpers import write_extension_ini_files
 from compile_helpers import is_web_app
 from compile_helpers import find_stand_alone_app_to_run
 from compile_helpers import load_manifest
+from compile_helpers import default_locale
+from compile_helpers import otel_resource_attributes
+from compile_helpers import upload_tmp_dir_commands
+from compile_helpers import write_secrets_profile
+from compile_helpers import php_ini_scan_dirs
+from compile_helpers import template_env
 from compile_helpers import find_all_php_versions
+from compile_helpers import find_php_eol_dates
 from compile_helpers import validate_php_version
+from compile_helpers import setup_runtime_txt_version
+from compile_helpers import validate_php_cli_version
 from compile_helpers import validate_php_extensions
 from compile_helpers import validate_php_ini_extensions
+from compile_helpers import apply_extension_blocklist
 from compile_helpers import include_fpm_d_confs
+from compile_helpers import link_php_extension_lib_dirs
+from compile_helpers import needs_sodium_module
+from compile_helpers import setup_grpc_extensions
+from compile_helpers import setup_fpm_pool_options
+from compile_helpers import setup_php_ini_options
+from compile_helpers import setup_memory_profiling
+from compile_helpers import setup_xdebug
+from compile_helpers import setup_opcache_preload
+from compile_helpers import check_memory_limit
+from compile_helpers import _is_enabled
 from extension_helpers import ExtensionHelper
 
 def find_composer_paths(ctx):
@@ -74,9 +96,15 @@ class PHPExtension(ExtensionHelper):
         manifest = load_manifest(self._ctx)
         dependencies = manifest['dependencies']
         self._ctx['ALL_PHP_VERSIONS'] = find_all_php_versions(dependencies)
+        self._ctx['PHP_EOL_DATES'] = find_php_eol_dates(manifest)
+        # runs before the composer extension, so composer.json wins
+        setup_runtime_txt_version(self._ctx)
 
     def _preprocess_commands(self):
-        return (('$HOME/.bp/bin/rewrite', '"$HOME/php/etc"'),)
+        commands = (('$HOME/.bp/bin/rewrite', '"$HOME/php/etc"'),)
+        if 'PHP_CLI_INSTALL_PATH' in self._ctx:
+            commands += (('$HOME/.bp/bin/rewrite', '"$HOME/php-cli/etc"'),)
+        return commands + upload_tmp_dir_commands(self._ctx)
 
     def _service_commands(self):
         if is_web_app(self._ctx):
@@ -100,14 +128,29 @@ class PHPExtension(ExtensionHelper):
         env = {
             'LD_LIBRARY_PATH': '$LD_LIBRARY_PATH:$HOME/php/lib',
             'PATH': '$PATH:$HOME/php/bin:$HOME/php/sbin',
-            'PHPRC': '$HOME/php/etc'
+            'PHPRC': '$HOME/php/etc',
+            'LANG': default_locale(self._ctx),
+            'LC_ALL': default_locale(self._ctx)
         }
+        # first, so `php` in tasks and `cf ssh` is the CLI PHP, FPM is
+        #  started by its full path and keeps using the web PHP
+        if 'PHP_CLI_INSTALL_PATH' in self._ctx:
+            env['PATH'] = '$HOME/php-cli/wrapper:' + env['PATH']
         if 'snmp' in self._ctx['PHP_EXTENSIONS']:
             env['MIBDIRS'] = '$HOME/php/mibs'
 
-        php_ini_d_path = os.path.join(self._ctx['BUILD_DIR'], 'php', 'etc', 'php.ini.d')
-        if os.path.exists(php_ini_d_path):
-            env['PHP_INI_SCAN_DIR'] = '$HOME/php/etc/php.ini.d/'
+        otel_attributes = otel_resource_attributes(self._ctx)
+        if otel_attributes:
+            env['OTEL_RESOURCE_ATTRIBUTES'] = '"%s"' % otel_attributes
+
+        scan_dirs = php_ini_scan_dirs(self._ctx)
+        if scan_dirs:
+            env['PHP_INI_SCAN_DIR'] = ':'.join(scan_dirs)
+
+        # read by bin/rewrite, when it fills in the configs at startup
+        names = template_env(self._ctx)
+        if names:
+            env['TEMPLATE_ENV'] = ':'.join(names)
 
         return env
 
@@ -130,19 +173,33 @@ class PHPExtension(ExtensionHelper):
             print("Warning: PHP_EXTENSIONS in options.json is deprecated. See: http://docs.cloudfoundry.org/buildpacks/php/gsg-php-config.html")
 
         print 'Installing PHP'
-        validate_php_version(ctx)
+        if not self._php_dependency_override():
+            validate_php_version(ctx)
         print 'PHP %s' % (ctx['PHP_VERSION'])
 
         major_minor = '.'.join(string.split(ctx['PHP_VERSION'], '.')[0:2])
 
-        (install
-            .package('PHP')
-            .done())
+        # an override PHP isn't in the manifest, so its modules are unknown
+        if not self._php_dependency_override():
+            setup_grpc_extensions(ctx)
+        self._install_php(install)
+
+        self._install_sodium(install)
 
         validate_php_ini_extensions(ctx)
         validate_php_extensions(ctx)
+        link_php_extension_lib_dirs(ctx)
+        setup_memory_profiling(ctx)
+        setup_xdebug(ctx)
+        setup_opcache_preload(ctx)
+        # after everything that adds extensions, so none of them get past it
+        apply_extension_blocklist(ctx)
+        ctx['EXTENSION_INI_FILES'] = write_extension_ini_files(ctx)
         convert_php_extensions(ctx)
         include_fpm_d_confs(ctx)
+        setup_php_ini_options(ctx)
+        setup_fpm_pool_options(ctx)
+        write_secrets_profile(ctx)
 
         (install
             .config()
@@ -151,9 +208,103 @@ class PHPExtension(ExtensionHelper):
                 .to('php/etc')
                 .rewrite()
                 .done())
+        check_memory_limit(ctx)
+
+        self._install_php_cli(install)
 
         return 0
 
+    def _install_sodium(self, install):
+        """Install the sodium module, which is only bundled with PHP 7.2+"""
+        if needs_sodium_module(install.builder._ctx):
+            print 'Installing sodium module for PHP %s' % (
+                install.builder._ctx['PHP_VERSION'])
+            (install
+                .modules('PHP')
+                .include_module('sodium')
+                .done())
+
+    def _php_dependency_override(self):
+        return _is_enabled(self._ctx.get('BP_PHP_DEPENDENCY_OVERRIDE', False))
+
+    def _install_php(self, install):
+        """Install PHP from the manifest or, with BP_PHP_DEPENDENCY_OVERRIDE,
+        from PHP_DEPENDENCY_URI after checking PHP_DEPENDENCY_SHA256"""
+        ctx = install.builder._ctx
+        if not self._php_dependency_override():
+            (install
+                .package('PHP')
+                .done())
+            return
+        uri = ctx.get('PHP_DEPENDENCY_URI')
+        sha256 = str(ctx.get('PHP_DEPENDENCY_SHA256', ''))
+        if not uri or not re.match(r'^[0-9a-fA-F]{64}$', sha256):
+            raise RuntimeError('BP_PHP_DEPENDENCY_OVERRIDE requires '
+                               'PHP_DEPENDENCY_URI and a valid '
+                               'PHP_DEPENDENCY_SHA256')
+        print 'Using PHP from [%s]' % uri
+        ctx['PHP_INSTALL_PATH'] = install._installer.install_binary_verified(
+            uri, sha256, os.path.join(ctx['BUILD_DIR'], 'php'),
+            strip=ctx.get('PHP_STRIP', False))
+
+    def _install_php_cli(self, install):
+        """Install a second PHP, used by the CLI, into `php-cli`"""
+        ctx = install.builder._ctx
+        if not validate_php_cli_version(ctx):
+            return
+        print 'PHP %s (CLI)' % (ctx['PHP_CLI_VERSION'])
+
+        major_minor = '.'.join(string.split(ctx['PHP_CLI_VERSION'], '.')[0:2])
+
+        (install
+            .package('PHP_CLI')
+            .done())
+
+        (install
+            .config()
+                .from_application('.bp-config/php')  # noqa
+                .or_from_build_pack('defaults/config/php/%s.x' % major_minor)
+                .to('php-cli/etc')
+                .rewrite()
+                .done())
+
+        # the CLI PHP loads its extensions from its own install
+        php_ini_path = os.path.join(ctx['BUILD_DIR'], 'php-cli', 'etc', 'php.ini')
+        if os.path.exists(php_ini_path):
+            php_ini = utils.ConfigFileEditor(php_ini_path)
+            php_ini.update_lines('^extension_dir = "@{HOME}/php/',
+                                 'extension_dir = "@{HOME}/php-cli/')
+            php_ini.save(php_ini_path)
+
+        # the web PHP's php.ini.d is for another PHP version, so the CLI has
+        #  its own, with the EXTENSION_PRIORITIES extensions which are loaded
+        #  by name from its extension_dir
+        web_ini_d = os.path.join(ctx['BUILD_DIR'], 'php', 'etc', 'php.ini.d')
+        cli_ini_d = os.path.join(ctx['BUILD_DIR'], 'php-cli', 'etc',
+                                 'php.ini.d')
+        utils.safe_makedirs(cli_ini_d)
+        for name in ctx.get('EXTENSION_INI_FILES', []):
+            with open(os.path.join(web_ini_d, name)) as f:
+                line = f.read()
+            if '@{HOME}' not in line and \
+                    not os.path.exists(os.path.join(cli_ini_d, name)):
+                with open(os.path.join(cli_ini_d, name), 'wt') as f:
+                    f.write(line)
+        scan_dirs = ['$HOME/php-cli/etc/php.ini.d/']
+        scan_dirs.extend(path for path in php_ini_scan_dirs(ctx)
+                         if path != '$HOME/php/etc/php.ini.d/')
+
+        # PHPRC and PHP_INI_SCAN_DIR point to the web PHP's config, so wrap
+        #  the CLI binary
+        wrapper_path = os.path.join(ctx['BUILD_DIR'], 'php-cli', 'wrapper', 'php')
+        utils.safe_makedirs(os.path.dirname(wrapper_path))
+        with open(wrapper_path, 'wt') as wrapper:
+            wrapper.write('#!/bin/bash\n'
+                          'export PHP_INI_SCAN_DIR="%s"\n'
+                          'exec "$HOME/php-cli/bin/php" '
+                          '-c "$HOME/php-cli/etc" "$@"\n' % ':'.join(scan_dirs))
+        os.chmod(wrapper_path, utils.umask_mode(ctx, 0755))
+
 
 # Register extension methods
 PHPExtension.register(__name__)
@@ -16,8 +16,13 @@
 # limitations under the License.
 from datetime import datetime
 from build_pack_utils import Builder
+from compile_helpers import validate_webdir
 from compile_helpers import setup_webdir_if_it_doesnt_exist
 from compile_helpers import setup_log_dir
+from compile_helpers import report_droplet_size
+from compile_helpers import write_image_labels
+from compile_helpers import warmup_dependency_cache
+from compile_helpers import prune_cache_dir
 
 
 if __name__ == '__main__':
@@ -28,6 +33,10 @@ if __name__ == '__main__':
             .user_config()
             .validate()
             .done()
+        .execute()
+            .method(prune_cache_dir)
+        .execute()
+            .method(validate_webdir)
         .execute()
             .method(setup_webdir_if_it_doesnt_exist)
         .execute()
@@ -51,13 +60,19 @@ if __name__ == '__main__':
                 .from_build_pack('extensions/caapm')
             .extension()
                 .from_build_pack('extensions/sessions')
+            .extension()
+                .from_build_pack('extensions/database')
             .extension()
                 .from_build_pack('extensions/composer')
+            .extension()
+                .from_build_pack('extensions/fpm_exporter')
             .extensions()
                 .from_application('.extensions')
             .extension()
                 .from_build_pack('lib/additional_commands')
             .done()
+        .execute()
+            .method(warmup_dependency_cache)
         .install()
             .build_pack_utils()
             .extensions()
@@ -72,9 +87,14 @@ if __name__ == '__main__':
         .save()
             .runtime_environment()
             .process_list()
+            .sidecar_list()
             .done()
         .create_start_script()
             .using_process_manager()
-            .write())
+            .write()
+        .execute()
+            .method(write_image_labels)
+        .execute()
+            .method(report_droplet_size))
 
     print 'Finished: [%s]' % datetime.now()
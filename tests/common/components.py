@@ -149,6 +149,8 @@ class HttpdAssertHelper(object):
                 .root('extra')
                     .path('httpd-modules.conf')  # noqa
                     .path('httpd-remoteip.conf')
+                    .path('httpd-headers.conf')
+                    .path('httpd-rewrite.conf')
             .root(build_dir, 'httpd', 'modules', reset=True)
                 .path('mod_authz_core.so')
                 .path('mod_authz_host.so')
@@ -0,0 +1,243 @@
+import os
+import stat
+import shutil
+import tempfile
+import mock
+import yaml
+from StringIO import StringIO
+from nose.tools import eq_
+from dingus import Dingus
+from dingus import patch
+from build_pack_utils import utils
+from build_pack_utils.builder import Installer
+from build_pack_utils.builder import Configurer
+from build_pack_utils.builder import Builder
+from build_pack_utils.builder import SaveBuilder
+
+
+class TestConfigInstallerUmask(object):
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    def _install_config(self, ctx):
+        builder = Dingus(_ctx=ctx)
+        (Installer(builder)
+            .config()
+            .from_build_pack('defaults/config/httpd')
+            .to('httpd/conf')
+            .rewrite()
+            .done())
+        return os.path.join(self.build_dir, 'httpd', 'conf', 'httpd.conf')
+
+    def test_config_honors_umask(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'BP_DIR': os.getcwd(),
+            'FILE_UMASK': '027'
+        })
+        path = self._install_config(ctx)
+        eq_(0640, stat.S_IMODE(os.stat(path).st_mode))
+
+    def test_config_without_umask_keeps_mode(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'BP_DIR': os.getcwd()
+        })
+        path = self._install_config(ctx)
+        eq_(stat.S_IMODE(os.stat('defaults/config/httpd/httpd.conf').st_mode),
+            stat.S_IMODE(os.stat(path).st_mode))
+
+    def test_umask_mode(self):
+        eq_(0755, utils.umask_mode({}, 0755))
+        eq_(0750, utils.umask_mode({'FILE_UMASK': '027'}, 0755))
+        eq_(0700, utils.umask_mode({'FILE_UMASK': '0077'}, 0755))
+
+    def test_validate_invalid_umask(self):
+        builder = Dingus(_ctx={'WEB_SERVER': 'httpd', 'FILE_UMASK': '089'})
+        try:
+            Configurer(builder).validate()
+            assert False, 'expected SystemExit'
+        except SystemExit, e:
+            eq_(1, e.code)
+
+    def test_is_valid_umask(self):
+        eq_(True, utils.is_valid_umask('022'))
+        eq_(True, utils.is_valid_umask('0027'))
+        eq_(False, utils.is_valid_umask('8'))
+        eq_(False, utils.is_valid_umask('07777'))
+        eq_(False, utils.is_valid_umask('abc'))
+
+
+class TestConfigInstallerOverrides(object):
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+        app_cfg_dir = os.path.join(self.build_dir, '.bp-config', 'httpd')
+        os.makedirs(os.path.join(app_cfg_dir, 'extra'))
+        with open(os.path.join(app_cfg_dir, 'httpd.conf'), 'wt') as f:
+            f.write('# custom httpd.conf\n')
+        with open(os.path.join(app_cfg_dir, 'extra', 'custom.conf'), 'wt') as f:
+            f.write('# new config\n')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    @mock.patch('build_pack_utils.builder._log')
+    def test_reports_shadowed_and_new_files(self, log):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'BP_DIR': os.getcwd()
+        })
+        (Installer(Dingus(_ctx=ctx))
+            .config()
+            .from_application('.bp-config/httpd')
+            .or_from_build_pack('defaults/config/httpd')
+            .to('httpd/conf')
+            .done())
+        messages = [c[0][0] % c[0][1:] for c in log.info.call_args_list]
+        assert ('User config [.bp-config/httpd/httpd.conf] overrides the '
+                'default [httpd/conf/httpd.conf]') in messages, messages
+        assert ('User config [.bp-config/httpd/extra/custom.conf] added to '
+                '[httpd/conf]') in messages, messages
+        with open(os.path.join(self.build_dir, 'httpd', 'conf',
+                               'httpd.conf')) as f:
+            eq_('# custom httpd.conf\n', f.read())
+
+
+class TestReleaseTasks(object):
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+
+    def tearDown(self):
+        shutil.rmtree(self.build_dir)
+
+    def _release(self, ctx):
+        builder = Builder()
+        builder._ctx = utils.FormattedDict(ctx)
+        builder._ctx['BUILD_DIR'] = self.build_dir
+        out = StringIO()
+        with patch('sys.stdout', out):
+            builder.release()
+        return yaml.safe_load(out.getvalue())
+
+    def test_release_without_tasks(self):
+        release = self._release({})
+        eq_({'web': '$HOME/.bp/bin/start'}, release['default_process_types'])
+
+    def test_release_tasks_added_as_process_types(self):
+        release = self._release({
+            'RELEASE_TASKS': {
+                'migrate': 'php artisan migrate --force',
+                'seed-db': 'php bin/console db:seed # one-off'
+            }
+        })
+        eq_({'web': '$HOME/.bp/bin/start',
+             'migrate': 'php artisan migrate --force',
+             'seed-db': 'php bin/console db:seed # one-off'},
+            release['default_process_types'])
+
+    def test_validate_invalid_release_tasks(self):
+        for tasks in ({'web': 'php migrate.php'},
+                      {'Bad Name': 'php migrate.php'},
+                      {'migrate': ''},
+                      {'migrate': 'php a.php\nphp b.php'},
+                      ['php migrate.php']):
+            builder = Dingus(_ctx={'WEB_SERVER': 'httpd',
+                                   'RELEASE_TASKS': tasks})
+            try:
+                Configurer(builder).validate()
+                assert False, 'expected SystemExit for %s' % tasks
+            except SystemExit, e:
+                eq_(1, e.code)
+
+
+class TestCustomStartCommand(object):
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+        os.makedirs(os.path.join(self.build_dir, 'bin'))
+        self.script = os.path.join(self.build_dir, 'bin', 'supervisord.sh')
+        with open(self.script, 'wt') as f:
+            f.write('#!/bin/bash\n')
+        os.chmod(self.script, 0755)
+
+    def tearDown(self):
+        shutil.rmtree(self.build_dir)
+
+    def _validate(self, start_cmd):
+        builder = Dingus(_ctx={'WEB_SERVER': 'httpd',
+                               'BUILD_DIR': self.build_dir,
+                               'CUSTOM_START_COMMAND': start_cmd})
+        Configurer(builder).validate()
+
+    def test_release_uses_custom_start_command(self):
+        builder = Builder()
+        builder._ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'CUSTOM_START_COMMAND': 'bin/supervisord.sh'})
+        out = StringIO()
+        with patch('sys.stdout', out):
+            builder.release()
+        release = yaml.safe_load(out.getvalue())
+        eq_({'web': '$HOME/bin/supervisord.sh'},
+            release['default_process_types'])
+
+    def test_validate_custom_start_command(self):
+        self._validate('bin/supervisord.sh')
+
+    def test_validate_invalid_custom_start_command(self):
+        os.chmod(self.script, 0644)
+        for start_cmd in ('/bin/supervisord.sh', '../supervisord.sh',
+                          'bin/missing.sh', 'bin/supervisord.sh -c x',
+                          'bin/supervisord.sh'):
+            try:
+                self._validate(start_cmd)
+                assert False, 'expected SystemExit for %s' % start_cmd
+            except SystemExit, e:
+                eq_(1, e.code)
+
+
+class TestShutdownDrainTimeout(object):
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    def test_runtime_environment_exports_drain_timeout(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'EXTENSIONS': [],
+            'SHUTDOWN_DRAIN_TIMEOUT': 30
+        })
+        SaveBuilder(Dingus(_ctx=ctx)).runtime_environment()
+        with open(os.path.join(self.build_dir, '.profile.d',
+                               'bp_env_vars.sh')) as f:
+            eq_('export SHUTDOWN_DRAIN_TIMEOUT=30\n', f.read())
+
+    def test_validate_invalid_droplet_size_warn(self):
+        for size_warn in ('1GB', '-5', ''):
+            builder = Dingus(_ctx={'WEB_SERVER': 'httpd',
+                                   'DROPLET_SIZE_WARN_MB': size_warn})
+            try:
+                Configurer(builder).validate()
+                assert False, 'expected SystemExit'
+            except SystemExit, e:
+                eq_(1, e.code)
+        for size_warn in (1024, '512', 0.5, None):
+            builder = Dingus(_ctx={'WEB_SERVER': 'httpd',
+                                   'DROPLET_SIZE_WARN_MB': size_warn})
+            Configurer(builder).validate()
+
+    def test_validate_invalid_drain_timeout(self):
+        builder = Dingus(_ctx={'WEB_SERVER': 'httpd',
+                               'SHUTDOWN_DRAIN_TIMEOUT': '-1'})
+        try:
+            Configurer(builder).validate()
+            assert False, 'expected SystemExit'
+        except SystemExit, e:
+            eq_(1, e.code)
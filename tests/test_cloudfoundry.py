@@ -1,8 +1,24 @@
 from nose.tools import eq_
+from mock import patch
 from build_pack_utils import cloudfoundry
+import os
+import shutil
+import hashlib
 import tempfile
 
 
+class StubDownloader(object):
+    """Downloads a file whose content is its url"""
+    def __init__(self):
+        self.downloaded = []
+
+    def download(self, url, to_dir):
+        self.downloaded.append(url)
+        name = url.split('/')[-1]
+        with open(os.path.join(to_dir, name), 'w') as f:
+            f.write(url)
+
+
 class TestCloudFoundryInstaller(object):
 
     def test_missing_dependency_from_manifest_raises_error(self):
@@ -21,3 +37,106 @@ class TestCloudFoundryInstaller(object):
             exception = e
 
         eq_("Could not download dependency: http://mock.com", str(exception))
+
+    def _write_manifest(self, bp_dir, url):
+        with open(os.path.join(bp_dir, 'manifest.yml'), 'w') as f:
+            f.write('url_to_dependency_map:\n'
+                    '- match: "\\\\/composer\\\\/(.*)\\\\/composer.phar"\n'
+                    '  name: composer\n'
+                    '  version: "$1"\n'
+                    'dependencies:\n'
+                    '- name: composer\n'
+                    '  version: 1.6.3\n'
+                    '  sha256: %s\n' % hashlib.sha256(url).hexdigest())
+
+    def test_warm_cache_fetches_into_cache(self):
+        cache_dir = tempfile.mkdtemp()
+        tmp_dir = tempfile.mkdtemp()
+        bp_dir = tempfile.mkdtemp()
+        self._write_manifest(bp_dir, '/composer/1.6.3/composer.phar')
+        stub = StubDownloader()
+        downloaded = stub.downloaded
+
+        instance = cloudfoundry.CloudFoundryInstaller({
+            'CACHE_DIR': cache_dir,
+            'BUILD_DIR': 'tests/data/composer',
+            'TMPDIR': tmp_dir,
+            'BP_DIR': bp_dir
+        })
+        instance._dwn = stub
+        instance.warm_cache(['/php/7.2.3/php-7.2.3.tar.gz',
+                             '/composer/1.6.3/composer.phar'])
+        eq_(['/composer/1.6.3/composer.phar', '/php/7.2.3/php-7.2.3.tar.gz'],
+            sorted(downloaded))
+        cached = os.path.join(cache_dir, 'dependencies',
+                              'composer', '1.6.3', 'composer.phar')
+        eq_(True, os.path.exists(cached))
+        eq_(True, os.path.exists(os.path.join(
+            cache_dir, 'dependencies', 'php', '7.2.3', 'php-7.2.3.tar.gz')))
+
+        # installs read through the cache, without downloading again
+        install_dir = tempfile.mkdtemp()
+        with patch('build_pack_utils.cloudfoundry.CompileExtensions') as ce:
+            ce.return_value.warn_if_newer_patch.return_value = (0, '')
+            instance._install_binary_from_manifest(
+                '/composer/1.6.3/composer.phar', install_dir, extract=False)
+        eq_(2, len(downloaded))
+        eq_(True, os.path.exists(os.path.join(install_dir, 'composer.phar')))
+        for path in (cache_dir, tmp_dir, bp_dir, install_dir):
+            shutil.rmtree(path)
+
+    def test_install_downloads_again_when_cached_file_is_corrupt(self):
+        url = '/composer/1.6.3/composer.phar'
+        cache_dir = tempfile.mkdtemp()
+        tmp_dir = tempfile.mkdtemp()
+        bp_dir = tempfile.mkdtemp()
+        install_dir = tempfile.mkdtemp()
+        self._write_manifest(bp_dir, url)
+        cached = os.path.join(cache_dir, 'dependencies',
+                              'composer', '1.6.3', 'composer.phar')
+        os.makedirs(os.path.dirname(cached))
+        with open(cached, 'w') as f:
+            f.write('truncated')
+        stub = StubDownloader()
+
+        instance = cloudfoundry.CloudFoundryInstaller({
+            'CACHE_DIR': cache_dir,
+            'BUILD_DIR': 'tests/data/composer',
+            'TMPDIR': tmp_dir,
+            'BP_DIR': bp_dir
+        })
+        instance._dwn = stub
+        instance._install_binary_from_manifest(url, install_dir,
+                                               extract=False)
+        eq_([url], stub.downloaded)
+        eq_(False, os.path.exists(cached))
+        with open(os.path.join(install_dir, 'composer.phar')) as f:
+            eq_(url, f.read())
+        for path in (cache_dir, tmp_dir, bp_dir, install_dir):
+            shutil.rmtree(path)
+
+    def test_install_binary_verified_checks_sha256(self):
+        tmp_dir = tempfile.mkdtemp()
+
+        class StubDownloader(object):
+            def custom_extension_download(self, url, filtered_url, to_file):
+                with open(to_file, 'w') as f:
+                    f.write('not the expected php')
+
+        instance = cloudfoundry.CloudFoundryInstaller({
+            'BUILD_DIR': 'tests/data/composer',
+            'TMPDIR': tmp_dir,
+            'BP_DIR': ''
+        })
+        instance._dwn = StubDownloader()
+        exception = None
+        try:
+            instance.install_binary_verified(
+                'https://php.example.com/php-7.2.3.tar.gz', 'a' * 64,
+                os.path.join(tmp_dir, 'php'))
+        except RuntimeError as e:
+            exception = e
+        shutil.rmtree(tmp_dir)
+
+        eq_("Checksum of downloaded dependency does not match expected value",
+            str(exception))
@@ -4,6 +4,8 @@ from build_pack_utils import utils
 import tempfile
 import shutil
 import os
+import logging
+import StringIO
 
 def buildpack_directory():
     directory = os.path.join(os.path.dirname(os.path.abspath(__file__)), '..')
@@ -60,6 +62,39 @@ class TestCloudFoundryUtil(object):
 
         eq_("Error detecting PHP default version", str(exception))
 
+    def test_log_file_gets_a_copy_of_the_log(self):
+        build_dir = tempfile.mkdtemp()
+        root = logging.getLogger()
+        (handlers, level) = (list(root.handlers), root.level)
+        buf = StringIO.StringIO()
+        stream = logging.StreamHandler(buf)
+        stream.setFormatter(logging.Formatter('%(message)s'))
+        root.handlers = [stream]
+        try:
+            CloudFoundryUtil.init_logging({'BUILD_DIR': build_dir,
+                                           'BP_DEBUG': True,
+                                           'BP_LOG_FILE': 'logs/build.log'})
+            eq_(2, len(root.handlers))
+            root.setLevel(logging.INFO)
+            log = logging.getLogger('test')
+            log.info('first message')
+            log.warning('second message')
+            for handler in root.handlers:
+                handler.flush()
+        finally:
+            for handler in root.handlers[1:]:
+                handler.close()
+            root.handlers = handlers
+            root.setLevel(level)
+        with open(os.path.join(build_dir, 'logs', 'build.log')) as f:
+            logged = [line.split(' - ', 1)[1] for line in f.read().splitlines()]
+        shutil.rmtree(build_dir)
+        eq_(['first message', 'second message'], logged)
+        eq_(logged, buf.getvalue().splitlines())
+
+
+
+
 BAD_MANIFEST = '''\
 ---
 language: php
@@ -2,19 +2,46 @@ import os
 import os.path
 import tempfile
 import shutil
+import datetime
+import json
+import time
+import subprocess
 import mock
 from nose.tools import eq_
 from nose.tools import assert_raises_regexp
 from build_pack_utils import utils
 from compile_helpers import setup_webdir_if_it_doesnt_exist
+from compile_helpers import validate_webdir
 from compile_helpers import convert_php_extensions
+from compile_helpers import write_extension_ini_files
 from compile_helpers import is_web_app
 from compile_helpers import find_stand_alone_app_to_run
 from compile_helpers import load_manifest
 from compile_helpers import find_all_php_versions
 from compile_helpers import validate_php_version
+from compile_helpers import validate_php_cli_version
+from compile_helpers import check_php_eol
+from compile_helpers import find_php_eol_dates
+from compile_helpers import setup_runtime_txt_version
+from compile_helpers import setup_fpm_pool_options
+from compile_helpers import report_droplet_size
+from compile_helpers import write_image_labels
+from compile_helpers import link_php_extension_lib_dirs
+from compile_helpers import setup_grpc_extensions
 from compile_helpers import validate_php_ini_extensions
+from compile_helpers import apply_extension_blocklist
 from compile_helpers import setup_log_dir
+from compile_helpers import warmup_dependency_cache
+from compile_helpers import prune_cache_dir
+from compile_helpers import write_secrets_profile
+from compile_helpers import setup_memory_profiling
+from compile_helpers import setup_xdebug
+from compile_helpers import xdebug_major_version
+from compile_helpers import setup_opcache_preload
+from compile_helpers import check_memory_limit
+from compile_helpers import installed_memory_limit
+from compile_helpers import installed_fpm_max_children
+from compile_helpers import setup_php_ini_options
 
 
 class TestCompileHelpers(object):
@@ -260,6 +287,108 @@ class TestCompileHelpers(object):
             ctx['ZEND_EXTENSIONS'])
 
 
+    def test_convert_php_extensions_from_extension_dirs(self):
+        for ext_dir, files in (('ext', ['custom.so', 'README']),
+                               ('vendor/ext', ['custom.so', 'zcustom.so'])):
+            os.makedirs(os.path.join(self.build_dir, ext_dir))
+            for f in files:
+                open(os.path.join(self.build_dir, ext_dir, f), 'w').close()
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'EXTENSION_DIRS': ['ext', 'vendor/ext/'],
+            'PHP_EXTENSIONS': ['bz2', 'custom'],
+            'ZEND_EXTENSIONS': ['zcustom']
+        })
+        convert_php_extensions(ctx)
+        eq_('extension=bz2.so\nextension=@{HOME}/ext/custom.so',
+            ctx['PHP_EXTENSIONS'])
+        eq_('zend_extension="@{HOME}/vendor/ext/zcustom.so"',
+            ctx['ZEND_EXTENSIONS'])
+
+    def test_extension_dirs_must_exist(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'EXTENSION_DIRS': ['missing'],
+            'PHP_EXTENSIONS': [],
+            'ZEND_EXTENSIONS': []
+        })
+        assert_raises_regexp(RuntimeError,
+                             r'\[missing\] does not exist',
+                             convert_php_extensions, ctx)
+
+    def test_extension_blocklist(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'EXTENSION_BLOCKLIST': 'pcntl, XDebug',
+            'PHP_EXTENSIONS': ['bz2', 'pcntl', 'zlib'],
+            'ZEND_EXTENSIONS': ['xdebug', 'opcache']
+        })
+        eq_(['pcntl', 'xdebug'], apply_extension_blocklist(ctx))
+        eq_(['bz2', 'zlib'], ctx['PHP_EXTENSIONS'])
+        eq_(['opcache'], ctx['ZEND_EXTENSIONS'])
+
+    def test_extension_blocklist_strict(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'EXTENSION_BLOCKLIST': ['pcntl'],
+            'EXTENSION_BLOCKLIST_STRICT': True,
+            'PHP_EXTENSIONS': ['bz2'],
+            'ZEND_EXTENSIONS': []
+        })
+        eq_([], apply_extension_blocklist(ctx))
+        ctx['PHP_EXTENSIONS'] = ['bz2', 'pcntl']
+        assert_raises_regexp(RuntimeError,
+                             'in EXTENSION_BLOCKLIST and can not be used: '
+                             'pcntl',
+                             apply_extension_blocklist, ctx)
+
+    def test_extension_blocklist_in_app_ini_files(self):
+        ini_d = os.path.join(self.build_dir, '.bp-config', 'php', 'php.ini.d')
+        os.makedirs(ini_d)
+        with open(os.path.join(ini_d, 'ext.ini'), 'w') as f:
+            f.write('extension=pcntl.so\n')
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'EXTENSION_BLOCKLIST': ['pcntl'],
+            'PHP_EXTENSIONS': [],
+            'ZEND_EXTENSIONS': []
+        })
+        assert_raises_regexp(RuntimeError,
+                             r'\[pcntl\], loaded by \[ext.ini\], is in '
+                             'EXTENSION_BLOCKLIST',
+                             apply_extension_blocklist, ctx)
+
+    def test_write_extension_ini_files(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'PHP_EXTENSIONS': ['bz2', 'redis', 'igbinary', 'xdebug'],
+            'ZEND_EXTENSIONS': ['opcache'],
+            'EXTENSION_PRIORITIES': {'igbinary': 10, 'redis': '20',
+                                     'xdebug': 90, 'opcache': 5}
+        })
+        eq_(['05-opcache.ini', '10-igbinary.ini', '20-redis.ini',
+             '90-xdebug.ini'], write_extension_ini_files(ctx))
+        ini_d = os.path.join(self.build_dir, 'php', 'etc', 'php.ini.d')
+        eq_(['05-opcache.ini', '10-igbinary.ini', '20-redis.ini',
+             '90-xdebug.ini'], sorted(os.listdir(ini_d)))
+        with open(os.path.join(ini_d, '20-redis.ini')) as f:
+            eq_('extension=redis.so\n', f.read())
+        with open(os.path.join(ini_d, '90-xdebug.ini')) as f:
+            eq_('zend_extension="xdebug.so"\n', f.read())
+        eq_(['bz2'], ctx['PHP_EXTENSIONS'])
+        eq_([], ctx['ZEND_EXTENSIONS'])
+
+    def test_write_extension_ini_files_invalid_priority(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'PHP_EXTENSIONS': ['redis'],
+            'ZEND_EXTENSIONS': [],
+            'EXTENSION_PRIORITIES': {'redis': 100}
+        })
+        assert_raises_regexp(RuntimeError,
+                             'EXTENSION_PRIORITIES values must be numbers',
+                             write_extension_ini_files, ctx)
+
     def setup_php_ini_dir(self, extensions):
         ini_dir = os.path.join(self.build_dir, '.bp-config', 'php', 'php.ini.d')
         os.makedirs(ini_dir)
@@ -364,3 +493,518 @@ class TestCompileHelpers(object):
         ctx['PHP_VERSION'] = '5.6.30'
         validate_php_version(ctx)
         eq_('5.6.30', ctx['PHP_VERSION'])
+
+    PHP_EOL_DATES = {
+        '5.6': datetime.date(2018, 12, 31),
+        '7.0': datetime.date(2018, 12, 3),
+        '7.1': datetime.date(2019, 12, 1),
+        '7.2': datetime.date(2020, 11, 30)
+    }
+
+    def test_find_php_eol_dates(self):
+        ctx = utils.FormattedDict({'BP_DIR': os.getcwd()})
+        eq_(self.PHP_EOL_DATES, find_php_eol_dates(load_manifest(ctx)))
+
+    def test_check_php_eol_warns(self):
+        ctx = utils.FormattedDict({
+            'ALL_PHP_VERSIONS': ['7.0.27', '7.1.14', '7.1.15', '7.2.3'],
+            'PHP_VERSION': '7.0.27',
+            'PHP_EOL_DATES': self.PHP_EOL_DATES
+        })
+        check_php_eol(ctx, today=datetime.date(2019, 6, 1))
+        eq_('7.0.27', ctx['PHP_VERSION'])
+
+    def test_check_php_eol_auto_upgrade(self):
+        ctx = utils.FormattedDict({
+            'ALL_PHP_VERSIONS': ['7.0.27', '7.1.14', '7.1.15', '7.2.3'],
+            'PHP_VERSION': '7.0.27',
+            'PHP_EOL_DATES': self.PHP_EOL_DATES,
+            'AUTO_UPGRADE_EOL_PHP': True
+        })
+        check_php_eol(ctx, today=datetime.date(2018, 6, 1))
+        eq_('7.0.27', ctx['PHP_VERSION'])
+        check_php_eol(ctx, today=datetime.date(2019, 6, 1))
+        eq_('7.1.15', ctx['PHP_VERSION'])
+        ctx['PHP_VERSION'] = '7.0.27'
+        check_php_eol(ctx, today=datetime.date(2020, 6, 1))
+        eq_('7.2.3', ctx['PHP_VERSION'])
+
+    def test_check_php_eol_auto_upgrade_past_the_table(self):
+        # every version in the table is EOL, newer ones aren't listed
+        ctx = utils.FormattedDict({
+            'ALL_PHP_VERSIONS': ['7.1.15', '7.2.3', '7.3.1', '7.3.2', '7.4.0'],
+            'PHP_VERSION': '7.2.3',
+            'PHP_EOL_DATES': self.PHP_EOL_DATES,
+            'AUTO_UPGRADE_EOL_PHP': True
+        })
+        check_php_eol(ctx, today=datetime.date(2021, 6, 1))
+        eq_('7.3.2', ctx['PHP_VERSION'])
+        check_php_eol(ctx, today=datetime.date(2021, 6, 1))
+        eq_('7.3.2', ctx['PHP_VERSION'])
+
+    def test_check_php_eol_auto_upgrade_stays_in_major(self):
+        ctx = utils.FormattedDict({
+            'ALL_PHP_VERSIONS': ['5.6.34', '7.2.3'],
+            'PHP_VERSION': '5.6.34',
+            'PHP_EOL_DATES': self.PHP_EOL_DATES,
+            'AUTO_UPGRADE_EOL_PHP': True
+        })
+        check_php_eol(ctx, today=datetime.date(2019, 6, 1))
+        eq_('5.6.34', ctx['PHP_VERSION'])
+
+    def _runtime_txt_ctx(self, contents):
+        os.makedirs(self.build_dir)
+        with open(os.path.join(self.build_dir, 'runtime.txt'), 'w') as f:
+            f.write(contents)
+        return utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'ALL_PHP_VERSIONS': ['5.6.34', '7.1.15', '7.2.2', '7.2.3'],
+            'PHP_56_LATEST': '5.6.34',
+            'PHP_VERSION': '5.6.34'
+        })
+
+    def test_setup_runtime_txt_version(self):
+        ctx = self._runtime_txt_ctx('php-7.1.15\n')
+        setup_runtime_txt_version(ctx)
+        eq_('7.1.15', ctx['PHP_VERSION'])
+
+    def test_setup_runtime_txt_version_minor(self):
+        ctx = self._runtime_txt_ctx('php-7.2\n')
+        setup_runtime_txt_version(ctx)
+        eq_('7.2.3', ctx['PHP_VERSION'])
+
+    def test_setup_runtime_txt_version_not_php(self):
+        ctx = self._runtime_txt_ctx('python-2.7.15\n')
+        setup_runtime_txt_version(ctx)
+        eq_('5.6.34', ctx['PHP_VERSION'])
+
+    def test_setup_runtime_txt_version_missing(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'PHP_VERSION': '5.6.34'
+        })
+        setup_runtime_txt_version(ctx)
+        eq_('5.6.34', ctx['PHP_VERSION'])
+
+    def test_setup_memory_profiling(self):
+        ctx = utils.FormattedDict({
+            'ZEND_EXTENSIONS': ['opcache'],
+            'PHP_EXTENSIONS': []
+        })
+        eq_(False, setup_memory_profiling(ctx))
+        eq_(['opcache'], ctx['ZEND_EXTENSIONS'])
+        setup_php_ini_options(ctx)
+        assert 'xdebug' not in ctx['PHP_INI_DIRECTIVES_CONF']
+        ctx['MEMORY_PROFILING'] = True
+        eq_(True, setup_memory_profiling(ctx))
+        eq_(['opcache', 'xdebug'], ctx['ZEND_EXTENSIONS'])
+        setup_memory_profiling(ctx)
+        eq_(['opcache', 'xdebug'], ctx['ZEND_EXTENSIONS'])
+        setup_php_ini_options(ctx)
+        assert 'xdebug.profiler_enable_trigger = On' in \
+            ctx['PHP_INI_DIRECTIVES_CONF']
+
+    def test_setup_xdebug(self):
+        ctx = utils.FormattedDict({
+            'ZEND_EXTENSIONS': ['opcache'],
+            'PHP_EXTENSIONS': [],
+            'BP_ENV': 'staging',
+            'XDEBUG': {'enabled': True, 'client_host': '10.0.0.5'}
+        })
+        eq_(True, setup_xdebug(ctx))
+        eq_(['opcache', 'xdebug'], ctx['ZEND_EXTENSIONS'])
+        setup_php_ini_options(ctx)
+        conf = ctx['PHP_INI_DIRECTIVES_CONF']
+        assert 'xdebug.remote_enable = On' in conf
+        assert 'xdebug.remote_host = 10.0.0.5' in conf
+        assert 'xdebug.remote_port = 9003' in conf
+        assert 'xdebug.mode' not in conf
+
+    def _install_xdebug(self, ini_names):
+        ext_dir = os.path.join(self.build_dir, 'php', 'lib', 'php',
+                               'extensions', 'no-debug-non-zts-20170718')
+        os.makedirs(ext_dir)
+        with open(os.path.join(ext_dir, 'xdebug.so'), 'wb') as f:
+            f.write(b'\x7fELF\x00' + b'\x00'.join(ini_names) + b'\x00')
+        return os.path.join(self.build_dir, 'php')
+
+    def test_setup_xdebug_matches_installed_xdebug_2(self):
+        ctx = utils.FormattedDict({
+            'ZEND_EXTENSIONS': [],
+            'PHP_EXTENSIONS': [],
+            'PHP_VERSION': '7.2.3',
+            'PHP_INSTALL_PATH': self._install_xdebug([
+                b'xdebug.remote_enable', b'xdebug.remote_host',
+                b'xdebug.remote_port', b'xdebug.profiler_enable']),
+            'XDEBUG': {'enabled': True, 'mode': 'debug,profile'}
+        })
+        eq_(2, xdebug_major_version(ctx))
+        setup_php_ini_options(ctx)
+        conf = ctx['PHP_INI_DIRECTIVES_CONF']
+        assert 'xdebug.remote_enable = On' in conf
+        assert 'xdebug.profiler_enable = On' in conf
+        assert 'xdebug.remote_host = localhost' in conf
+        assert 'xdebug.client_host' not in conf
+
+    def test_setup_xdebug_matches_installed_xdebug_3(self):
+        ctx = utils.FormattedDict({
+            'ZEND_EXTENSIONS': [],
+            'PHP_EXTENSIONS': [],
+            'PHP_VERSION': '7.2.3',
+            'PHP_INSTALL_PATH': self._install_xdebug([
+                b'xdebug.mode', b'xdebug.client_host',
+                b'xdebug.client_port']),
+            'MEMORY_PROFILING': True,
+            'XDEBUG': {'enabled': True}
+        })
+        eq_(3, xdebug_major_version(ctx))
+        setup_php_ini_options(ctx)
+        conf = ctx['PHP_INI_DIRECTIVES_CONF']
+        assert 'xdebug.mode = profile,debug' in conf
+        assert 'xdebug.client_host = localhost' in conf
+        assert 'xdebug.start_with_request = trigger' in conf
+        assert 'xdebug.remote_enable' not in conf
+        assert 'xdebug.profiler_enable_trigger' not in conf
+
+    def test_setup_xdebug_refused_in_production(self):
+        ctx = utils.FormattedDict({
+            'ZEND_EXTENSIONS': ['opcache'],
+            'PHP_EXTENSIONS': [],
+            'BP_ENV': 'production',
+            'XDEBUG': {'enabled': True}
+        })
+        eq_(False, setup_xdebug(ctx))
+        eq_(['opcache'], ctx['ZEND_EXTENSIONS'])
+        setup_php_ini_options(ctx)
+        assert 'xdebug' not in ctx['PHP_INI_DIRECTIVES_CONF']
+
+    def test_setup_opcache_preload(self):
+        ctx = utils.FormattedDict({
+            'ZEND_EXTENSIONS': [],
+            'PHP_EXTENSIONS': [],
+            'PHP_VERSION': '7.2.3',
+            'OPCACHE_PRELOAD_COMPOSER': True
+        })
+        eq_(False, setup_opcache_preload(ctx))
+        setup_php_ini_options(ctx)
+        assert 'opcache.preload' not in ctx['PHP_INI_DIRECTIVES_CONF']
+        ctx['PHP_VERSION'] = '7.4.1'
+        eq_(True, setup_opcache_preload(ctx))
+        eq_(['opcache'], ctx['ZEND_EXTENSIONS'])
+        setup_php_ini_options(ctx)
+        assert 'opcache.preload = @{HOME}/.bp/opcache-preload.php' in \
+            ctx['PHP_INI_DIRECTIVES_CONF']
+
+    def _check_memory_limit(self, ctx, env):
+        saved = dict((k, os.environ.get(k)) for k in env)
+        os.environ.update(env)
+        try:
+            return check_memory_limit(ctx)
+        finally:
+            for k, v in saved.items():
+                if v is None:
+                    del os.environ[k]
+                else:
+                    os.environ[k] = v
+
+    def _write_php_etc(self, name, data):
+        path = os.path.join(self.build_dir, 'php', 'etc', name)
+        if not os.path.exists(os.path.dirname(path)):
+            os.makedirs(os.path.dirname(path))
+        with open(path, 'wt') as f:
+            f.write(data)
+
+    def test_check_memory_limit(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir})
+        # 128M x 5 workers fits in 1G, but not in 512M
+        eq_(False, self._check_memory_limit(ctx, {'MEMORY_LIMIT': '1024m'}))
+        eq_(True, self._check_memory_limit(ctx, {'MEMORY_LIMIT': '512m'}))
+        self._write_php_etc('php.ini', '[PHP]\nmemory_limit = 128M\n'
+                                       'memory_limit = 256M\n')
+        eq_(True, self._check_memory_limit(ctx, {'MEMORY_LIMIT': '1G'}))
+        self._write_php_etc('php.ini', 'memory_limit = -1\n')
+        eq_(False, self._check_memory_limit(ctx, {'MEMORY_LIMIT': '256m'}))
+
+    def test_check_memory_limit_reads_installed_configs(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir})
+        self._write_php_etc('php.ini', 'memory_limit = 128M\n')
+        # php.ini.d is read after php.ini
+        self._write_php_etc('php.ini.d/app.ini', 'memory_limit = "64M"\n')
+        self._write_php_etc('php-fpm.conf', '[global]\n'
+                                            ';pm.max_children = 50\n'
+                                            '[www]\npm.max_children = 5\n'
+                                            'pm.max_children = 20\n')
+        eq_('64M', installed_memory_limit(ctx))
+        eq_(20, installed_fpm_max_children(ctx))
+        # 64M x 20 workers doesn't fit in 1G
+        eq_(True, self._check_memory_limit(ctx, {'MEMORY_LIMIT': '1G'}))
+        # every pool's workers count
+        self._write_php_etc('fpm.d/other.conf', '[other]\n'
+                                                'pm.max_children = 4\n')
+        eq_(24, installed_fpm_max_children(ctx))
+        self._write_php_etc('php-fpm.conf', '[www]\npm.max_children = 2\n')
+        self._write_php_etc('fpm.d/other.conf', '')
+        eq_(False, self._check_memory_limit(ctx, {'MEMORY_LIMIT': '256m'}))
+
+    def test_check_memory_limit_from_vcap_application(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir})
+        eq_(True, self._check_memory_limit(ctx, {
+            'MEMORY_LIMIT': '',
+            'VCAP_APPLICATION': '{"limits": {"mem": 256}}'}))
+
+    def test_validate_php_cli_version(self):
+        ctx = utils.FormattedDict({
+            'ALL_PHP_VERSIONS': ['5.6.31', '7.1.3'],
+            'PHP_VERSION': '5.6.31',
+            'PHP_STRIP': True
+        })
+        eq_(False, validate_php_cli_version(ctx))
+        ctx['PHP_CLI_VERSION'] = '5.6.31'
+        eq_(False, validate_php_cli_version(ctx))
+        ctx['PHP_CLI_VERSION'] = '7.0.1'
+        eq_(False, validate_php_cli_version(ctx))
+        assert 'PHP_CLI_DOWNLOAD_URL' not in ctx
+        ctx['PHP_CLI_VERSION'] = '7.1.3'
+        eq_(True, validate_php_cli_version(ctx))
+        eq_('/php/7.1.3/php-7.1.3.tar.gz', ctx['PHP_CLI_DOWNLOAD_URL'])
+        eq_('php-cli', ctx['PHP_CLI_PACKAGE_INSTALL_DIR'])
+
+    def test_setup_fpm_pool_options_catch_workers_output(self):
+        ctx = utils.FormattedDict({'PHP_VERSION': '7.2.3'})
+        setup_fpm_pool_options(ctx)
+        eq_('catch_workers_output = yes',
+            ctx['PHP_FPM_CATCH_WORKERS_OUTPUT_CONF'])
+        eq_('', ctx['PHP_FPM_DECORATE_WORKERS_OUTPUT_CONF'])
+        ctx['PHP_FPM_CATCH_WORKERS_OUTPUT'] = False
+        setup_fpm_pool_options(ctx)
+        eq_('catch_workers_output = yes',
+            ctx['PHP_FPM_CATCH_WORKERS_OUTPUT_CONF'])
+        ctx['PHP_ERROR_LOG'] = '@{HOME}/logs/php_errors.log'
+        setup_fpm_pool_options(ctx)
+        eq_('catch_workers_output = no',
+            ctx['PHP_FPM_CATCH_WORKERS_OUTPUT_CONF'])
+        ctx['PHP_FPM_CATCH_WORKERS_OUTPUT'] = 'yes'
+        setup_fpm_pool_options(ctx)
+        eq_('catch_workers_output = yes',
+            ctx['PHP_FPM_CATCH_WORKERS_OUTPUT_CONF'])
+
+    def test_setup_fpm_pool_options_clear_env(self):
+        ctx = utils.FormattedDict({
+            'PHP_VERSION': '7.2.3',
+            'PHP_FPM_ENV_PASSTHROUGH': ['PATH', 'VCAP_SERVICES']
+        })
+        setup_fpm_pool_options(ctx)
+        eq_('clear_env = no', ctx['PHP_FPM_CLEAR_ENV_CONF'])
+        eq_('env[PATH] = $PATH\nenv[VCAP_SERVICES] = $VCAP_SERVICES',
+            ctx['PHP_FPM_ENV_PASSTHROUGH_CONF'])
+        ctx['PHP_FPM_CLEAR_ENV'] = True
+        setup_fpm_pool_options(ctx)
+        eq_('clear_env = yes', ctx['PHP_FPM_CLEAR_ENV_CONF'])
+
+    def test_setup_fpm_pool_options_status(self):
+        ctx = utils.FormattedDict({'PHP_VERSION': '7.2.3'})
+        setup_fpm_pool_options(ctx)
+        eq_(';pm.status_path = /status', ctx['PHP_FPM_STATUS_CONF'])
+        ctx['PHP_FPM_STATUS'] = True
+        setup_fpm_pool_options(ctx)
+        eq_('pm.status_path = /fpm-status', ctx['PHP_FPM_STATUS_CONF'])
+        ctx['PHP_FPM_STATUS'] = '/status'
+        setup_fpm_pool_options(ctx)
+        eq_('pm.status_path = /status', ctx['PHP_FPM_STATUS_CONF'])
+
+    def test_setup_fpm_pool_options_decorate_workers_output(self):
+        ctx = utils.FormattedDict({
+            'PHP_VERSION': '7.2.3',
+            'PHP_FPM_DECORATE_WORKERS_OUTPUT': False
+        })
+        setup_fpm_pool_options(ctx)
+        eq_('', ctx['PHP_FPM_DECORATE_WORKERS_OUTPUT_CONF'])
+        ctx['PHP_VERSION'] = '7.3.0'
+        setup_fpm_pool_options(ctx)
+        eq_('decorate_workers_output = no',
+            ctx['PHP_FPM_DECORATE_WORKERS_OUTPUT_CONF'])
+
+    @mock.patch('compile_helpers._log')
+    @mock.patch('compile_helpers._dir_size', return_value=600 * 1024 * 1024)
+    def test_report_droplet_size_above_threshold(self, dir_size, log):
+        report_droplet_size({'BUILD_DIR': self.build_dir,
+                             'DROPLET_SIZE_WARN_MB': 500})
+        eq_(True, log.warning.called)
+
+    @mock.patch('compile_helpers._log')
+    @mock.patch('compile_helpers._dir_size', return_value=400 * 1024 * 1024)
+    def test_report_droplet_size_below_threshold(self, dir_size, log):
+        report_droplet_size({'BUILD_DIR': self.build_dir,
+                             'DROPLET_SIZE_WARN_MB': 500})
+        eq_(False, log.warning.called)
+        eq_(True, log.info.called)
+
+    @mock.patch('compile_helpers.CloudFoundryInstaller')
+    def test_warmup_dependency_cache(self, installer):
+        ctx = utils.FormattedDict({
+            'PHP_VERSION': '7.2.3',
+            'PHP_DOWNLOAD_URL': '/php/{PHP_VERSION}/php-{PHP_VERSION}.tar.gz',
+            'COMPOSER_DOWNLOAD_URL': '/composer/1.6.3/composer.phar',
+            'DEPENDENCY_WARMUP': ['php', 'composer', 'missing']
+        })
+        warmup_dependency_cache(ctx)
+        eq_(1, len(installer.return_value.warm_cache.call_args_list))
+        eq_((['/php/7.2.3/php-7.2.3.tar.gz', '/composer/1.6.3/composer.phar'],),
+            installer.return_value.warm_cache.call_args[0])
+
+    @mock.patch('compile_helpers.CloudFoundryInstaller')
+    def test_warmup_dependency_cache_not_configured(self, installer):
+        warmup_dependency_cache(utils.FormattedDict({}))
+        eq_(False, installer.called)
+
+    def test_write_image_labels(self):
+        os.makedirs(self.build_dir)
+        bp_dir = os.path.join(self.build_dir, 'bp')
+        os.makedirs(bp_dir)
+        with open(os.path.join(bp_dir, 'VERSION'), 'w') as f:
+            f.write('4.3.51\n')
+        ctx = {'BUILD_DIR': self.build_dir, 'BP_DIR': bp_dir,
+               'PHP_VERSION': '7.2.3'}
+        eq_(None, write_image_labels(ctx))
+        ctx['IMAGE_LABELS'] = True
+        path = write_image_labels(ctx)
+        eq_(os.path.join(self.build_dir, '.bp', 'image-labels.json'), path)
+        with open(path) as f:
+            labels = json.load(f)
+        eq_('7.2.3', labels['org.cloudfoundry.php-buildpack.php-version'])
+        eq_('4.3.51', labels['org.cloudfoundry.php-buildpack.version'])
+        created = datetime.datetime.strptime(
+            labels['org.opencontainers.image.created'], '%Y-%m-%dT%H:%M:%SZ')
+        assert abs(datetime.datetime.utcnow() - created).total_seconds() < 60
+
+    def test_prune_cache_dir(self):
+        composer_dir = os.path.join(self.cache_dir, 'composer', 'files')
+        os.makedirs(composer_dir)
+        now = time.time()
+        for i, name in enumerate(('old', 'older', 'newest', 'new')):
+            path = os.path.join(composer_dir if i < 2 else self.cache_dir,
+                                name)
+            with open(path, 'wb') as f:
+                f.write(b'x' * 512 * 1024)
+            used = now - {'older': 400, 'old': 300,
+                          'new': 200, 'newest': 100}[name]
+            os.utime(path, (used, used))
+        ctx = {'CACHE_DIR': self.cache_dir, 'BP_CACHE_MAX_MB': '1'}
+        eq_(2, prune_cache_dir(ctx))
+        eq_(['new', 'newest'], sorted(os.listdir(self.cache_dir)))
+        ctx['BP_CACHE_MAX_MB'] = 2
+        eq_(0, prune_cache_dir(ctx))
+
+    def test_prune_cache_dir_not_configured(self):
+        os.makedirs(self.cache_dir)
+        open(os.path.join(self.cache_dir, 'file'), 'w').close()
+        eq_(0, prune_cache_dir({'CACHE_DIR': self.cache_dir}))
+        eq_(['file'], os.listdir(self.cache_dir))
+
+    def test_write_secrets_profile(self):
+        secrets_dir = os.path.join(self.build_dir, 'secrets')
+        os.makedirs(os.path.join(secrets_dir, 'nested'))
+        for name, value in (('DB_PASSWORD', 's3cr3t $HOME "x"\n'),
+                            ('api_key', 'abc'),
+                            ('not-a-name', 'skipped')):
+            with open(os.path.join(secrets_dir, name), 'w') as f:
+                f.write(value)
+        write_secrets_profile({'BUILD_DIR': self.build_dir,
+                               'SECRETS_DIR': secrets_dir + '/'})
+        script = os.path.join(self.build_dir, '.profile.d', 'bp_secrets.sh')
+        assert 's3cr3t' not in open(script).read()
+        env = subprocess.check_output(
+            ['bash', '-c', '. "%s" && env' % script]).split('\n')
+        assert 'DB_PASSWORD=s3cr3t $HOME "x"' in env
+        assert 'api_key=abc' in env
+        eq_([], [line for line in env if 'skipped' in line])
+
+    def test_write_secrets_profile_missing_dir(self):
+        write_secrets_profile({'BUILD_DIR': self.build_dir,
+                               'SECRETS_DIR': '/does/not/exist'})
+        script = os.path.join(self.build_dir, '.profile.d', 'bp_secrets.sh')
+        eq_(0, subprocess.call(['bash', '-c', '. "%s"' % script]))
+        write_secrets_profile({'BUILD_DIR': self.build_dir})
+        assert_raises_regexp(RuntimeError,
+                             'SECRETS_DIR must be an absolute path',
+                             write_secrets_profile,
+                             {'BUILD_DIR': self.build_dir,
+                              'SECRETS_DIR': 'secrets'})
+
+    def _grpc_ctx(self, modules):
+        bp_dir = os.path.join(self.build_dir, 'bp')
+        os.makedirs(bp_dir)
+        with open(os.path.join(bp_dir, 'manifest.yml'), 'w') as f:
+            f.write('dependencies:\n'
+                    '- name: php\n'
+                    '  version: 7.2.3\n'
+                    '  modules: [%s]\n' % ', '.join(modules))
+        return {
+            'BP_DIR': bp_dir,
+            'BUILD_DIR': self.build_dir,
+            'PHP_VERSION': '7.2.3',
+            'PHP_EXTENSIONS': ['bz2', 'grpc']
+        }
+
+    def test_setup_grpc_extensions(self):
+        ctx = self._grpc_ctx(['bz2', 'grpc', 'protobuf'])
+        eq_(True, setup_grpc_extensions(ctx))
+        eq_(['bz2', 'grpc', 'protobuf'], ctx['PHP_EXTENSIONS'])
+        grpc_dir = os.path.join(self.build_dir, 'php', 'lib', 'grpc')
+        os.makedirs(grpc_dir)
+        open(os.path.join(grpc_dir, 'libgrpc.so.6'), 'w').close()
+        link_php_extension_lib_dirs(ctx)
+        eq_(True, os.path.islink(os.path.join(self.build_dir, 'php', 'lib',
+                                              'libgrpc.so.6')))
+
+    def test_setup_grpc_extensions_not_in_manifest(self):
+        ctx = self._grpc_ctx(['bz2', 'protobuf'])
+        assert_raises_regexp(RuntimeError,
+                             'The grpc extension, needed for gRPC, is not '
+                             'available for PHP 7.2.3',
+                             setup_grpc_extensions, ctx)
+
+    def test_link_php_extension_lib_dirs(self):
+        gd_dir = os.path.join(self.build_dir, 'php', 'lib', 'gd')
+        os.makedirs(gd_dir)
+        open(os.path.join(gd_dir, 'libgd.so.3'), 'w').close()
+        ctx = {
+            'BUILD_DIR': self.build_dir,
+            'PHP_EXTENSIONS': ['bz2', 'gd']
+        }
+        link_php_extension_lib_dirs(ctx)
+        link_path = os.path.join(self.build_dir, 'php', 'lib', 'libgd.so.3')
+        eq_(True, os.path.islink(link_path))
+        eq_(os.path.join('gd', 'libgd.so.3'), os.readlink(link_path))
+        # linking again is a no-op
+        link_php_extension_lib_dirs(ctx)
+        eq_(True, os.path.islink(link_path))
+
+    def test_link_php_extension_lib_dirs_not_enabled(self):
+        gd_dir = os.path.join(self.build_dir, 'php', 'lib', 'gd')
+        os.makedirs(gd_dir)
+        open(os.path.join(gd_dir, 'libgd.so.3'), 'w').close()
+        link_php_extension_lib_dirs({
+            'BUILD_DIR': self.build_dir,
+            'PHP_EXTENSIONS': ['bz2']
+        })
+        eq_(False, os.path.exists(
+            os.path.join(self.build_dir, 'php', 'lib', 'libgd.so.3')))
+
+    def test_validate_webdir(self):
+        validate_webdir({'BUILD_DIR': '/tmp/app', 'WEBDIR': 'htdocs'})
+        validate_webdir({'BUILD_DIR': '/tmp/app', 'WEBDIR': 'public/../htdocs'})
+        validate_webdir({'BUILD_DIR': '/tmp/app', 'WEBDIR': ''})
+
+    def test_validate_webdir_rejects_traversal(self):
+        assert_raises_regexp(RuntimeError, 'must be located inside',
+                             validate_webdir,
+                             {'BUILD_DIR': '/tmp/app', 'WEBDIR': '../../etc'})
+        assert_raises_regexp(RuntimeError, 'must be located inside',
+                             validate_webdir,
+                             {'BUILD_DIR': '/tmp/app', 'WEBDIR': '../app-other'})
+
+    def test_validate_webdir_rejects_absolute_path(self):
+        assert_raises_regexp(RuntimeError, 'must be a path relative',
+                             validate_webdir,
+                             {'BUILD_DIR': '/tmp/app', 'WEBDIR': '/etc'})
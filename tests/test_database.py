@@ -0,0 +1,144 @@
+# Licensed to the Apache Software Foundation (ASF) under one or more
+# contributor license agreements.  See the NOTICE file distributed with
+# this work for additional information regarding copyright ownership.
+# The ASF licenses this file to You under the Apache License, Version 2.0
+# (the "License"); you may not use this file except in compliance with
+# the License.  You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+import os
+import json
+import shutil
+import tempfile
+import subprocess
+from dingus import Dingus
+from nose.tools import eq_
+from nose.tools import assert_raises_regexp
+from build_pack_utils import utils
+
+
+class TestDatabase(object):
+
+    def __init__(self):
+        self.extension_module = utils.load_extension('extensions/database')
+
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    def _ctx(self, *names):
+        ctx = json.load(open('tests/data/database/vcap_services.json'))
+        for provider, services in ctx['VCAP_SERVICES'].items():
+            services = [s for s in services if s['name'] in names]
+            if services:
+                ctx['VCAP_SERVICES'][provider] = services
+            else:
+                del ctx['VCAP_SERVICES'][provider]
+        ctx['PHP_EXTENSIONS'] = ['bz2']
+        ctx['BUILD_DIR'] = self.build_dir
+        return ctx
+
+    def _profile_env(self, vcap_services):
+        """Source the profile.d script, like the app's container does"""
+        env = {'PATH': os.environ['PATH'],
+               'VCAP_SERVICES': json.dumps(vcap_services)}
+        if 'PYENV_VERSION' in os.environ:
+            env['PYENV_VERSION'] = os.environ['PYENV_VERSION']
+        output = subprocess.check_output(
+            ['bash', '-c', '. .profile.d/bp_database.sh && env -0'],
+            cwd=self.build_dir, env=env)
+        return dict(line.split('=', 1)
+                    for line in output.split('\0') if '=' in line)
+
+    def test_no_database_bound(self):
+        ctx = self._ctx('redis-sessions')
+        db = self.extension_module.DatabaseExtension(ctx)
+        eq_(False, db._should_compile())
+        db.configure()
+        eq_(['bz2'], ctx['PHP_EXTENSIONS'])
+
+    def test_configure_adds_pdo_mysql(self):
+        ctx = self._ctx('app-db', 'redis-sessions')
+        self.extension_module.DatabaseExtension(ctx).configure()
+        eq_(['bz2', 'pdo_mysql'], ctx['PHP_EXTENSIONS'])
+
+    def test_configure_adds_pdo_pgsql(self):
+        ctx = self._ctx('reports-db')
+        self.extension_module.DatabaseExtension(ctx).configure()
+        eq_(['bz2', 'pdo_pgsql'], ctx['PHP_EXTENSIONS'])
+
+    def test_configure_adds_each_bound_database(self):
+        ctx = self._ctx('app-db', 'reports-db')
+        ctx['PHP_EXTENSIONS'].append('pdo_mysql')
+        self.extension_module.DatabaseExtension(ctx).configure()
+        eq_(['bz2', 'pdo_mysql', 'pdo_pgsql'], ctx['PHP_EXTENSIONS'])
+
+    def test_compile_off_by_default(self):
+        db = self.extension_module.DatabaseExtension(self._ctx('app-db'))
+        eq_({}, db.service_environment())
+        db.compile(Dingus())
+        eq_(False, os.path.exists(os.path.join(self.build_dir, '.profile.d')))
+
+    def test_profile_exports_credentials_at_startup(self):
+        ctx = self._ctx('app-db')
+        ctx['DATABASE_ENV'] = True
+        self.extension_module.DatabaseExtension(ctx).compile(Dingus())
+        with open(os.path.join(self.build_dir, '.profile.d',
+                               'bp_database.sh')) as f:
+            assert 'my\'pass' not in f.read()
+        # credentials rotated after staging are picked up
+        ctx['VCAP_SERVICES']['p.mysql'][0]['credentials']['password'] = \
+            "new'pass"
+        env = self._profile_env(ctx['VCAP_SERVICES'])
+        eq_('mysql', env['DB_CONNECTION'])
+        eq_('mysql-host', env['DB_HOST'])
+        eq_('3306', env['DB_PORT'])
+        eq_('service_instance_db', env['DB_DATABASE'])
+        eq_('app-user', env['DB_USERNAME'])
+        eq_("new'pass", env['DB_PASSWORD'])
+        assert env['DATABASE_URL'].startswith('mysql://app-user:')
+
+    def test_profile_exports_credentials_from_uri(self):
+        ctx = self._ctx('reports-db')
+        ctx['DATABASE_ENV'] = True
+        self.extension_module.DatabaseExtension(ctx).compile(Dingus())
+        env = self._profile_env(ctx['VCAP_SERVICES'])
+        eq_('pgsql', env['DB_CONNECTION'])
+        eq_('pg-host', env['DB_HOST'])
+        eq_('5432', env['DB_PORT'])
+        eq_('reports', env['DB_DATABASE'])
+        eq_('pg-user', env['DB_USERNAME'])
+        eq_('pg-pass', env['DB_PASSWORD'])
+
+    def test_profile_without_bound_database(self):
+        ctx = self._ctx('reports-db')
+        ctx['DATABASE_ENV'] = True
+        self.extension_module.DatabaseExtension(ctx).compile(Dingus())
+        env = self._profile_env({})
+        assert 'DB_CONNECTION' not in env
+        assert 'DATABASE_URL' not in env
+
+    def test_compile_needs_a_name_for_many_databases(self):
+        ctx = self._ctx('app-db', 'reports-db')
+        ctx['DATABASE_ENV'] = True
+        db = self.extension_module.DatabaseExtension(ctx)
+        assert_raises_regexp(RuntimeError,
+                             'More than one database is bound',
+                             db.compile, Dingus())
+        ctx['DATABASE_SERVICE_NAME'] = 'reports-db'
+        db.compile(Dingus())
+        eq_('pgsql',
+            self._profile_env(ctx['VCAP_SERVICES'])['DB_CONNECTION'])
+        ctx['DATABASE_SERVICE_NAME'] = 'other-db'
+        assert_raises_regexp(RuntimeError,
+                             'no bound database has that name',
+                             db.compile, Dingus())
@@ -0,0 +1,159 @@
+# Licensed to the Apache Software Foundation (ASF) under one or more
+# contributor license agreements.  See the NOTICE file distributed with
+# this work for additional information regarding copyright ownership.
+# The ASF licenses this file to You under the Apache License, Version 2.0
+# (the "License"); you may not use this file except in compliance with
+# the License.  You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+import os
+import shutil
+import tempfile
+import yaml
+from StringIO import StringIO
+from dingus import Dingus
+from dingus import patch
+from nose.tools import eq_
+from nose.tools import assert_raises_regexp
+from build_pack_utils import utils
+from build_pack_utils.builder import Builder
+from build_pack_utils.builder import SaveBuilder
+
+
+class TestFpmExporter(object):
+
+    def __init__(self):
+        self.extension_module = utils.load_extension('extensions/fpm_exporter')
+
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    def _ctx(self, **kwargs):
+        ctx = utils.FormattedDict({
+            'BP_DIR': os.getcwd(),
+            'BUILD_DIR': self.build_dir,
+            'WEB_SERVER': 'httpd',
+            'PHP_FPM_LISTEN': '127.0.0.1:9000',
+            'PHP_FPM_STATUS': True,
+            'FPM_METRICS_EXPORTER': True
+        })
+        ctx.update(kwargs)
+        return ctx
+
+    def _install_exporter(self):
+        bin_dir = os.path.join(self.build_dir, 'php-fpm-exporter')
+        os.makedirs(bin_dir)
+        open(os.path.join(bin_dir, 'php-fpm_exporter'), 'w').close()
+
+    def test_should_compile(self):
+        exporter = self.extension_module.FpmExporterExtension(self._ctx())
+        eq_(True, exporter._should_compile())
+        exporter = self.extension_module.FpmExporterExtension(
+            self._ctx(FPM_METRICS_EXPORTER=False))
+        eq_(False, exporter._should_compile())
+        exporter = self.extension_module.FpmExporterExtension(
+            self._ctx(WEB_SERVER='none'))
+        eq_(False, exporter._should_compile())
+
+    def test_configure_fails_without_manifest_dependency(self):
+        # the shipped manifest
+        exporter = self.extension_module.FpmExporterExtension(self._ctx())
+        assert_raises_regexp(RuntimeError,
+                             'does not provide php-fpm-exporter',
+                             exporter.configure)
+        exporter = self.extension_module.FpmExporterExtension(
+            self._ctx(FPM_METRICS_EXPORTER=False))
+        exporter.configure()
+
+    def test_compile_skipped_without_status_page(self):
+        install = Dingus()
+        exporter = self.extension_module.FpmExporterExtension(
+            self._ctx(PHP_FPM_STATUS=False))
+        exporter._manifest_version = lambda: '0.5.0'
+        exporter.configure()
+        exporter.compile(install)
+        eq_(0, len(install.calls('package')))
+
+    def test_compile_installs_exporter(self):
+        install = Dingus()
+        ctx = self._ctx()
+        exporter = self.extension_module.FpmExporterExtension(ctx)
+        exporter._manifest_version = lambda: '0.5.0'
+        exporter.configure()
+        exporter.compile(install)
+        eq_(1, len(install.calls('package')))
+        eq_('PHP_FPM_EXPORTER', install.calls('package')[0].args[0])
+        eq_('/php-fpm-exporter/0.5.0/php-fpm-exporter-0.5.0.tar.gz',
+            ctx['PHP_FPM_EXPORTER_DOWNLOAD_URL'])
+
+    def test_sidecar_commands(self):
+        self._install_exporter()
+        exporter = self.extension_module.FpmExporterExtension(self._ctx())
+        eq_({}, exporter.service_commands())
+        cmds = exporter.sidecar_commands()
+        eq_(1, len(cmds))
+        eq_(('$HOME/php-fpm-exporter/php-fpm_exporter',
+             'server',
+             '--phpfpm.scrape-uri "tcp://127.0.0.1:9000/fpm-status"',
+             '--web.listen-address ":9253"'), cmds['fpm-exporter'])
+
+    def test_sidecar_commands_unix_socket(self):
+        self._install_exporter()
+        exporter = self.extension_module.FpmExporterExtension(self._ctx(
+            PHP_FPM_LISTEN='/tmp/php-fpm.socket',
+            PHP_FPM_STATUS='/status'))
+        cmds = exporter.sidecar_commands()
+        eq_('--phpfpm.scrape-uri "unix:///tmp/php-fpm.socket;/status"',
+            cmds['fpm-exporter'][2])
+
+    def test_sidecar_commands_not_installed(self):
+        exporter = self.extension_module.FpmExporterExtension(self._ctx())
+        eq_({}, exporter.sidecar_commands())
+        self._install_exporter()
+        exporter = self.extension_module.FpmExporterExtension(
+            self._ctx(FPM_METRICS_EXPORTER=False))
+        eq_({}, exporter.sidecar_commands())
+
+    def test_release_adds_exporter_sidecar(self):
+        self._install_exporter()
+        ctx = self._ctx(EXTENSIONS=[
+            os.path.join(os.getcwd(), 'extensions', 'fpm_exporter')])
+        builder = Builder()
+        builder._ctx = ctx
+        SaveBuilder(builder).process_list().sidecar_list()
+        out = StringIO()
+        with patch('sys.stdout', out):
+            builder.release()
+        release = yaml.safe_load(out.getvalue())
+        eq_({'web': '$HOME/.bp/bin/start'}, release['default_process_types'])
+        eq_([{'name': 'fpm-exporter',
+              'process_types': ['web'],
+              'command': '$HOME/php-fpm-exporter/php-fpm_exporter server '
+                         '--phpfpm.scrape-uri '
+                         '"tcp://127.0.0.1:9000/fpm-status" '
+                         '--web.listen-address ":9253"'}],
+            release['sidecars'])
+        # it isn't started by the process manager in the web process
+        with open(os.path.join(self.build_dir, '.procs')) as f:
+            eq_('', f.read())
+
+    def test_release_without_exporter(self):
+        ctx = self._ctx(EXTENSIONS=[
+            os.path.join(os.getcwd(), 'extensions', 'fpm_exporter')])
+        builder = Builder()
+        builder._ctx = ctx
+        SaveBuilder(builder).sidecar_list()
+        out = StringIO()
+        with patch('sys.stdout', out):
+            builder.release()
+        assert 'sidecars' not in yaml.safe_load(out.getvalue())
@@ -0,0 +1,903 @@
+import os
+import shutil
+import subprocess
+import tempfile
+from dingus import Dingus
+from nose.tools import eq_
+from nose.tools import assert_raises_regexp
+from build_pack_utils import utils
+
+
+class TestHttpdExtension(object):
+    def setUp(self):
+        self.extension_module = utils.load_extension('lib/httpd')
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    def test_service_commands_waits_for_php_fpm(self):
+        ctx = utils.FormattedDict({
+            'PHP_FPM_LISTEN': '127.0.0.1:9000'
+        })
+        cmd = ' '.join(self.extension_module.service_commands(ctx)['httpd'])
+        assert cmd.startswith('i=0; while [ $i -lt')
+        assert '${PHP_FPM_READY_TIMEOUT:-10}' in cmd
+        assert 'fsockopen("127.0.0.1", 9000)' in cmd
+        assert 'sleep 0.1; done;' in cmd
+        assert cmd.index('done;') < cmd.index('exec $HOME/httpd/bin/apachectl')
+
+    def test_wait_for_php_fpm_warns_on_timeout(self):
+        ctx = utils.FormattedDict({'PHP_FPM_LISTEN': '127.0.0.1:9000'})
+        cmd = self.extension_module.wait_for_php_fpm(ctx)
+        # nothing listens and php isn't there, so the wait times out
+        out = subprocess.check_output(
+            cmd, shell=True, stderr=subprocess.STDOUT,
+            env={'HOME': self.build_dir, 'PHP_FPM_READY_TIMEOUT': '0'})
+        eq_('WARNING: PHP-FPM did not accept connections within 0s, '
+            'starting httpd anyway\n', out)
+
+    def test_service_commands_start_order(self):
+        ctx = utils.FormattedDict({'PHP_FPM_LISTEN': '127.0.0.1:9000',
+                                   'START_ORDER': 'fpm-first'})
+        cmd = self.extension_module.service_commands(ctx)['httpd']
+        assert cmd[0].startswith('i=0; while [ $i -lt')
+        eq_('exec', cmd[1])
+        ctx['START_ORDER'] = 'httpd-first'
+        cmd = self.extension_module.service_commands(ctx)['httpd']
+        eq_('exec', cmd[0])
+        eq_(-1, ' '.join(cmd).find('fsockopen'))
+        self.extension_module.setup_php_retry(ctx)
+        eq_('proxy:balancer://php-fpm', ctx['HTTPD_PHP_HANDLER'])
+        ctx['START_ORDER'] = 'php-first'
+        assert_raises_regexp(RuntimeError,
+                             'START_ORDER must be `fpm-first` or '
+                             '`httpd-first`',
+                             self.extension_module.service_commands, ctx)
+
+    def test_service_commands_start_httpd_in_foreground(self):
+        cmd = self.extension_module.service_commands({})['httpd']
+        eq_('-DFOREGROUND', cmd[-1])
+        eq_('-k start', cmd[-2])
+
+    def test_service_commands_warmup_request(self):
+        ctx = utils.FormattedDict({'PHP_FPM_LISTEN': '127.0.0.1:9000'})
+        cmd = ' '.join(self.extension_module.service_commands(ctx)['httpd'])
+        eq_(-1, cmd.find('curl'))
+        ctx['WARMUP_URL'] = '/warmup?cache=1'
+        cmd = ' '.join(self.extension_module.service_commands(ctx)['httpd'])
+        assert 'curl -s -o /dev/null -m 60 ' \
+            '"http://127.0.0.1:$PORT/warmup?cache=1" || true) &' in cmd
+        assert cmd.index('fsockopen') < cmd.index('curl')
+        assert cmd.index(') &') < cmd.index('exec $HOME/httpd/bin/apachectl')
+
+    def test_warmup_request_with_tls(self):
+        ctx = utils.FormattedDict({
+            'WARMUP_URL': '/warmup',
+            'TLS': {'cert': 'certs/app.crt', 'key': 'certs/app.key'}
+        })
+        cmd = self.extension_module.warmup_request(ctx)
+        assert '! curl -k -s -o /dev/null https://127.0.0.1:$PORT/;' in cmd
+        assert 'curl -k -s -o /dev/null -m 60 ' \
+            '"https://127.0.0.1:$PORT/warmup" || true) &' in cmd
+        eq_(-1, cmd.find('http://'))
+
+    def test_warmup_url_must_be_path(self):
+        ctx = utils.FormattedDict({'WARMUP_URL': 'http://example.com/"'})
+        assert_raises_regexp(RuntimeError, 'WARMUP_URL must be a path',
+                             self.extension_module.warmup_request, ctx)
+
+    def test_content_security_policy_not_set(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_content_security_policy(ctx)
+        eq_('', ctx['HTTPD_CONTENT_SECURITY_POLICY'])
+
+    def test_content_security_policy_enforcing(self):
+        ctx = utils.FormattedDict({
+            'CONTENT_SECURITY_POLICY': "default-src 'self'"
+        })
+        self.extension_module.setup_content_security_policy(ctx)
+        eq_('Header set Content-Security-Policy "default-src \'self\'"',
+            ctx['HTTPD_CONTENT_SECURITY_POLICY'])
+
+    def test_content_security_policy_report_only(self):
+        ctx = utils.FormattedDict({
+            'CONTENT_SECURITY_POLICY': "default-src 'self'",
+            'CONTENT_SECURITY_POLICY_REPORT_ONLY': True
+        })
+        self.extension_module.setup_content_security_policy(ctx)
+        eq_('Header set Content-Security-Policy-Report-Only '
+            '"default-src \'self\'"',
+            ctx['HTTPD_CONTENT_SECURITY_POLICY'])
+        ctx['CONTENT_SECURITY_POLICY_REPORT_ONLY'] = 'false'
+        self.extension_module.setup_content_security_policy(ctx)
+        eq_('Header set Content-Security-Policy "default-src \'self\'"',
+            ctx['HTTPD_CONTENT_SECURITY_POLICY'])
+
+    def test_content_security_policy_directives(self):
+        ctx = utils.FormattedDict({
+            'CONTENT_SECURITY_POLICY': {
+                'default-src': "'self'",
+                'img-src': ["'self'", 'data:'],
+                'upgrade-insecure-requests': ''
+            }
+        })
+        self.extension_module.setup_content_security_policy(ctx)
+        eq_('Header set Content-Security-Policy "default-src \'self\'; '
+            'img-src \'self\' data:; upgrade-insecure-requests"',
+            ctx['HTTPD_CONTENT_SECURITY_POLICY'])
+
+    def test_rewrite_rules_not_set(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_rewrite_rules(ctx)
+        eq_('', ctx['HTTPD_REWRITE_RULES'])
+
+    def test_rewrite_rules_in_order(self):
+        ctx = utils.FormattedDict({
+            'REWRITE_RULES': [
+                {'from': '^/old/(.*)$', 'to': '/new/$1', 'flags': 'R=301,L'},
+                {'from': '^/api/(.*)$', 'to': '/index.php', 'flags': ['QSA', 'L']},
+                {'from': '^/([a-z]{2})/about$', 'to': '/about.php?lang=$1'}
+            ]
+        })
+        self.extension_module.setup_rewrite_rules(ctx)
+        lines = ctx['HTTPD_REWRITE_RULES'].split('\n')
+        eq_('RewriteEngine On', lines[0])
+        eq_('RewriteRule ^/old/(.*)$ /new/$1 [R=301,L]', lines[1])
+        eq_('RewriteRule ^/api/(.*)$ /index.php [QSA,L]', lines[2])
+        eq_('RewriteRule ^/([a-z]{2})/about$ /about.php?lang=$1', lines[3])
+
+    def test_trailing_slash_preserve(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_trailing_slash(ctx)
+        eq_('', ctx['HTTPD_TRAILING_SLASH'])
+
+    def test_trailing_slash_add(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'htdocs',
+                                   'TRAILING_SLASH': 'add'})
+        self.extension_module.setup_trailing_slash(ctx)
+        lines = ctx['HTTPD_TRAILING_SLASH'].split('\n')
+        eq_(['RewriteEngine On',
+             'RewriteCond %{REQUEST_URI} !^/index\\.php(/|$)',
+             'RewriteCond %{DOCUMENT_ROOT}%{REQUEST_URI} !-f',
+             'RewriteCond %{REQUEST_URI} !\\.[A-Za-z0-9]+$',
+             'RewriteRule ^(.*[^/])$ $1/ [R=301,L]'], lines)
+
+    def test_trailing_slash_remove(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'htdocs',
+                                   'BASE_PATH': '/shop',
+                                   'FRONT_CONTROLLER': 'app.php',
+                                   'TRAILING_SLASH': 'remove'})
+        self.extension_module.setup_trailing_slash(ctx)
+        lines = ctx['HTTPD_TRAILING_SLASH'].split('\n')
+        eq_(['RewriteEngine On',
+             'RewriteCond %{REQUEST_URI} !^/shop/app\\.php(/|$)',
+             'RewriteCond %{DOCUMENT_ROOT}%{REQUEST_URI} !-d',
+             'RewriteRule ^(.+)/$ $1 [R=301,L]'], lines)
+
+    def test_trailing_slash_invalid(self):
+        ctx = utils.FormattedDict({'TRAILING_SLASH': 'sometimes'})
+        assert_raises_regexp(RuntimeError, 'TRAILING_SLASH must be one of',
+                             self.extension_module.setup_trailing_slash, ctx)
+
+    def test_rewrite_rules_missing_to(self):
+        ctx = utils.FormattedDict({
+            'REWRITE_RULES': [{'from': '^/old$'}]
+        })
+        assert_raises_regexp(RuntimeError, 'must have a `from` and a `to`',
+                             self.extension_module.setup_rewrite_rules, ctx)
+
+    def test_access_log_exclude_not_set(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_access_log_exclude(ctx)
+        eq_('', ctx['HTTPD_ACCESS_LOG_EXCLUDE'])
+
+    def test_access_log_exclude(self):
+        ctx = utils.FormattedDict({
+            'ACCESS_LOG_EXCLUDE': ['/healthcheck', '/status.php']
+        })
+        self.extension_module.setup_access_log_exclude(ctx)
+        self.extension_module.setup_access_log_format(ctx)
+        cfg = os.path.join(self.build_dir, 'httpd-logging.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-logging.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            lines = [line.strip() for line in f.readlines()]
+        assert 'SetEnvIf Request_URI "^/healthcheck$" dontlog' in lines
+        assert 'SetEnvIf Request_URI "^/status\\.php$" dontlog' in lines
+        assert 'CustomLog "|/usr/bin/tee" extended env=!dontlog' in lines
+
+    def test_access_log_presets(self):
+        cfg = os.path.join(self.build_dir, 'httpd-logging.conf')
+        for preset in ('combined', 'common', 'json'):
+            ctx = utils.FormattedDict({'ACCESS_LOG_PRESET': preset})
+            self.extension_module.setup_access_log_exclude(ctx)
+            self.extension_module.setup_access_log_format(ctx)
+            shutil.copy('defaults/config/httpd/extra/httpd-logging.conf', cfg)
+            utils.rewrite_cfgs(cfg, ctx, delim='#')
+            with open(cfg) as f:
+                lines = [line.strip() for line in f.readlines()]
+            assert ('CustomLog "|/usr/bin/tee" %s env=!dontlog' % preset) \
+                in lines
+            formats = [line for line in lines
+                       if line.startswith('LogFormat') and
+                       line.endswith(' %s' % preset)]
+            eq_(1, len(formats))
+        fmt = formats[0][len('LogFormat "'):-len('" json')]
+        assert fmt.startswith('{\\"time\\":')
+        assert '\\"status\\":%>s,' in fmt
+
+    def test_access_log_preset_must_be_known(self):
+        ctx = utils.FormattedDict({'ACCESS_LOG_PRESET': 'xml'})
+        assert_raises_regexp(RuntimeError,
+                             'ACCESS_LOG_PRESET must be one of',
+                             self.extension_module.setup_access_log_format,
+                             ctx)
+
+    def test_request_id_disabled(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_request_id(ctx)
+        eq_('', ctx['HTTPD_REQUEST_ID'])
+
+    def test_request_id_enabled(self):
+        ctx = utils.FormattedDict({
+            'REQUEST_ID_HEADER': True,
+            'HTTPD_CONTENT_SECURITY_POLICY': ''
+        })
+        self.extension_module.setup_request_id(ctx)
+        cfg = os.path.join(self.build_dir, 'httpd-headers.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-headers.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            lines = [line.strip() for line in f.readlines()]
+        assert 'LoadModule unique_id_module modules/mod_unique_id.so' in lines
+        assert 'RequestHeader setifempty X-Request-Id "%{UNIQUE_ID}e"' in lines
+        assert 'Header always set X-Request-Id "%{X-Request-Id}i"' in lines
+
+    def test_request_id_custom_header(self):
+        ctx = utils.FormattedDict({
+            'REQUEST_ID_HEADER': 'X-Correlation-Id'
+        })
+        self.extension_module.setup_request_id(ctx)
+        assert 'RequestHeader setifempty X-Correlation-Id "%{UNIQUE_ID}e"' \
+            in ctx['HTTPD_REQUEST_ID']
+
+    def _render_headers(self, ctx):
+        ctx['HTTPD_CONTENT_SECURITY_POLICY'] = ''
+        ctx['HTTPD_REQUEST_ID'] = ''
+        cfg = os.path.join(self.build_dir, 'httpd-headers.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-headers.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return [line.strip() for line in f.readlines()]
+
+    def test_static_cache_control_default(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_static_cache_control(ctx)
+        lines = self._render_headers(ctx)
+        assert '<FilesMatch "\\.(gif|ico|jpe?g|png|svg|webp)$">' in lines
+        assert 'Header set Cache-Control "public, max-age=3600"' in lines
+        assert '<FilesMatch "\\.(css|js)$">' in lines
+        assert 'Header set Cache-Control "public, max-age=300"' in lines
+        assert '<FilesMatch "\\.(eot|otf|ttf|woff2?)$">' in lines
+        assert 'Header set Cache-Control "public, max-age=86400"' in lines
+
+    def test_static_cache_control_configured(self):
+        ctx = utils.FormattedDict({
+            'STATIC_CACHE_CONTROL': {'css_js': 604800, 'fonts': False}
+        })
+        self.extension_module.setup_static_cache_control(ctx)
+        lines = self._render_headers(ctx)
+        eq_(['<FilesMatch "\\.(gif|ico|jpe?g|png|svg|webp)$">',
+             'Header set Cache-Control "public, max-age=3600"',
+             '</FilesMatch>',
+             '<FilesMatch "\\.(css|js)$">',
+             'Header set Cache-Control "public, max-age=604800"',
+             '</FilesMatch>'],
+            [line for line in lines if line])
+        ctx['STATIC_CACHE_CONTROL'] = False
+        self.extension_module.setup_static_cache_control(ctx)
+        eq_('', ctx['HTTPD_STATIC_CACHE_CONTROL'])
+
+    def test_static_cache_control_unknown_group(self):
+        ctx = utils.FormattedDict({'STATIC_CACHE_CONTROL': {'videos': 60}})
+        assert_raises_regexp(RuntimeError,
+                             'STATIC_CACHE_CONTROL groups must be one of',
+                             self.extension_module.setup_static_cache_control,
+                             ctx)
+
+    def _render_httpd_conf(self, ctx):
+        cfg = os.path.join(self.build_dir, 'httpd.conf')
+        shutil.copy('defaults/config/httpd/httpd.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return [line.strip() for line in f.readlines()]
+
+    def test_tls_disabled(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'htdocs'})
+        self.extension_module.setup_tls(ctx)
+        lines = self._render_httpd_conf(ctx)
+        eq_([], [line for line in lines if 'SSL' in line])
+
+    def test_tls_enabled(self):
+        os.makedirs(os.path.join(self.build_dir, 'certs'))
+        for name in ('app.crt', 'app.key'):
+            open(os.path.join(self.build_dir, 'certs', name), 'w').close()
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'WEBDIR': 'htdocs',
+            'TLS': {'cert': 'certs/app.crt', 'key': 'certs/app.key',
+                    'protocols': ['-all', '+TLSv1.2', '+TLSv1.3']}
+        })
+        self.extension_module.setup_tls(ctx)
+        lines = self._render_httpd_conf(ctx)
+        assert 'LoadModule ssl_module modules/mod_ssl.so' in lines
+        assert 'SSLEngine on' in lines
+        assert 'SSLCertificateFile "${HOME}/certs/app.crt"' in lines
+        assert 'SSLCertificateKeyFile "${HOME}/certs/app.key"' in lines
+        assert 'SSLProtocol -all +TLSv1.2 +TLSv1.3' in lines
+        assert 'SSLCipherSuite %s' % \
+            self.extension_module.TLS_DEFAULTS['ciphers'] in lines
+
+    def test_tls_files_must_exist(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'TLS': {'cert': 'app.crt', 'key': 'app.key'}
+        })
+        assert_raises_regexp(RuntimeError,
+                             r'TLS cert \[app.crt\] does not exist',
+                             self.extension_module.setup_tls, ctx)
+
+    def test_fallback_resource_disabled(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_fallback_resource(ctx)
+        eq_('', ctx['HTTPD_FALLBACK_RESOURCE'])
+
+    def test_fallback_resource_enabled(self):
+        ctx = utils.FormattedDict({
+            'WEBDIR': 'htdocs',
+            'FALLBACK_TO_FRONT_CONTROLLER': True
+        })
+        self.extension_module.setup_fallback_resource(ctx)
+        cfg = os.path.join(self.build_dir, 'httpd-directories.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-directories.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            s = f.read()
+        webdir = s.index('<Directory "${HOME}/htdocs">')
+        fallback = s.index('    FallbackResource /index.php\n')
+        assert webdir < fallback < s.index('</Directory>', webdir)
+
+    def test_fallback_resource_custom_path(self):
+        ctx = utils.FormattedDict({
+            'FALLBACK_TO_FRONT_CONTROLLER': '/app.php'
+        })
+        self.extension_module.setup_fallback_resource(ctx)
+        eq_('FallbackResource /app.php', ctx['HTTPD_FALLBACK_RESOURCE'])
+
+    def test_timeout_defaults_are_coherent(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_timeout(ctx)
+        assert 'PHP_FPM_REQUEST_TERMINATE_TIMEOUT' not in ctx
+        eq_(60, ctx['HTTPD_TIMEOUT'])
+        ctx = utils.FormattedDict({'PHP_FPM_REQUEST_TERMINATE_TIMEOUT': 60})
+        self.extension_module.setup_timeout(ctx)
+        eq_(65, ctx['HTTPD_TIMEOUT'])
+        ctx = utils.FormattedDict({'PHP_FPM_REQUEST_TERMINATE_TIMEOUT': 300})
+        self.extension_module.setup_timeout(ctx)
+        eq_(305, ctx['HTTPD_TIMEOUT'])
+
+    def test_timeout_warns_when_httpd_gives_up_first(self):
+        log = Dingus()
+        self.extension_module._log = log
+        ctx = utils.FormattedDict({
+            'PHP_FPM_REQUEST_TERMINATE_TIMEOUT': 120,
+            'HTTPD_TIMEOUT': 90
+        })
+        self.extension_module.setup_timeout(ctx)
+        eq_(90, ctx['HTTPD_TIMEOUT'])
+        eq_(1, len(log.calls('warning')))
+        ctx = utils.FormattedDict({
+            'PHP_FPM_REQUEST_TERMINATE_TIMEOUT': 120,
+            'HTTPD_TIMEOUT': '150'
+        })
+        self.extension_module.setup_timeout(ctx)
+        eq_(150, ctx['HTTPD_TIMEOUT'])
+        eq_(1, len(log.calls('warning')))
+        ctx = utils.FormattedDict({'HTTPD_TIMEOUT': 90})
+        self.extension_module.setup_timeout(ctx)
+        eq_(90, ctx['HTTPD_TIMEOUT'])
+        eq_(1, len(log.calls('warning')))
+
+    def _render_remote_ip(self, ctx):
+        cfg = os.path.join(self.build_dir, 'httpd-remoteip.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-remoteip.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return f.read().split('\n')
+
+    def test_remote_ip_defaults(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir})
+        self.extension_module.setup_remote_ip(ctx)
+        self.extension_module.setup_rate_limit(ctx)
+        lines = self._render_remote_ip(ctx)
+        assert 'RemoteIpHeader X-Forwarded-For' in lines
+        assert 'RemoteIpInternalProxy 10.0.0.0/8 172.16.0.0/12 ' \
+            '192.168.0.0/16' in lines
+
+    def test_remote_ip_configured(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'REAL_IP_HEADER': 'X-Real-IP',
+            'REAL_IP_TRUSTED_PROXIES': ['10.10.0.0/16', '203.0.113.7']
+        })
+        self.extension_module.setup_remote_ip(ctx)
+        self.extension_module.setup_rate_limit(ctx)
+        lines = self._render_remote_ip(ctx)
+        assert 'RemoteIpHeader X-Real-IP' in lines
+        assert 'RemoteIPTrustedProxy 10.10.0.0/16 203.0.113.7' in lines
+        assert not [line for line in lines
+                    if line.startswith('RemoteIpInternalProxy')]
+
+    def test_remote_ip_must_be_valid(self):
+        ctx = utils.FormattedDict({'REAL_IP_HEADER': 'X-Real-IP\nfoo'})
+        assert_raises_regexp(RuntimeError, 'REAL_IP_HEADER must be',
+                             self.extension_module.setup_remote_ip, ctx)
+        ctx = utils.FormattedDict({'REAL_IP_TRUSTED_PROXIES': ['a b']})
+        assert_raises_regexp(RuntimeError, 'REAL_IP_TRUSTED_PROXIES must be',
+                             self.extension_module.setup_remote_ip, ctx)
+
+    def test_rate_limit_not_set(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir})
+        self.extension_module.setup_rate_limit(ctx)
+        eq_('', ctx['HTTPD_RATE_LIMIT'])
+
+    def test_rate_limit_with_mod_evasive(self):
+        modules = os.path.join(self.build_dir, 'httpd', 'modules')
+        os.makedirs(modules)
+        open(os.path.join(modules, 'mod_evasive24.so'), 'w').close()
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'RATE_LIMIT': {'requests_per_second': 10, 'burst': 5}
+        })
+        self.extension_module.setup_rate_limit(ctx)
+        cfg = os.path.join(self.build_dir, 'httpd-remoteip.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-remoteip.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            lines = f.read().split('\n')
+        assert '  LoadModule evasive20_module modules/mod_evasive24.so' in lines
+        assert 'DOSSiteCount 15' in lines
+        assert 'DOSPageCount 15' in lines
+        assert 'DOSBlockingPeriod 10' in lines
+
+    def test_rate_limit_with_mod_qos(self):
+        modules = os.path.join(self.build_dir, 'httpd', 'modules')
+        os.makedirs(modules)
+        open(os.path.join(modules, 'mod_qos.so'), 'w').close()
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'RATE_LIMIT': {'requests_per_second': 10}
+        })
+        self.extension_module.setup_rate_limit(ctx)
+        lines = ctx['HTTPD_RATE_LIMIT'].split('\n')
+        assert 'QS_ClientEventLimitCount 10 1' in lines
+
+    def test_rate_limit_warns_without_module(self):
+        log = Dingus()
+        self.extension_module._log = log
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'RATE_LIMIT': {'requests_per_second': 10}
+        })
+        self.extension_module.setup_rate_limit(ctx)
+        eq_('', ctx['HTTPD_RATE_LIMIT'])
+        eq_(1, len(log.calls('warning')))
+
+    def test_rate_limit_must_be_valid(self):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'RATE_LIMIT': {'requests_per_second': 'lots'}
+        })
+        assert_raises_regexp(RuntimeError, 'requests_per_second must be',
+                             self.extension_module.setup_rate_limit, ctx)
+
+    def _render_default_conf(self, ctx):
+        cfg = os.path.join(self.build_dir, 'httpd-default.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-default.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return f.read().split('\n')
+
+    def test_allow_encoded_slashes(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_allow_encoded_slashes(ctx)
+        assert 'AllowEncodedSlashes Off' in self._render_default_conf(ctx)
+        ctx = utils.FormattedDict({'ALLOW_ENCODED_SLASHES': 'nodecode'})
+        self.extension_module.setup_allow_encoded_slashes(ctx)
+        assert 'AllowEncodedSlashes NoDecode' in \
+            self._render_default_conf(ctx)
+        ctx = utils.FormattedDict({'ALLOW_ENCODED_SLASHES': 'On'})
+        self.extension_module.setup_allow_encoded_slashes(ctx)
+        assert 'AllowEncodedSlashes On' in self._render_default_conf(ctx)
+
+    def test_allow_encoded_slashes_invalid(self):
+        ctx = utils.FormattedDict({'ALLOW_ENCODED_SLASHES': 'yes'})
+        assert_raises_regexp(RuntimeError,
+                             'ALLOW_ENCODED_SLASHES must be one of',
+                             self.extension_module.setup_allow_encoded_slashes,
+                             ctx)
+
+    def test_limit_request_field_size(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_limit_request_field_size(ctx)
+        assert 'LimitRequestFieldSize 8190' in self._render_default_conf(ctx)
+        ctx = utils.FormattedDict({'HTTPD_LIMIT_REQUEST_FIELD_SIZE': '32768'})
+        self.extension_module.setup_limit_request_field_size(ctx)
+        assert 'LimitRequestFieldSize 32768' in self._render_default_conf(ctx)
+
+    def test_limit_request_field_size_must_be_positive(self):
+        for size in (0, '16k'):
+            ctx = utils.FormattedDict({'HTTPD_LIMIT_REQUEST_FIELD_SIZE': size})
+            assert_raises_regexp(
+                RuntimeError,
+                'HTTPD_LIMIT_REQUEST_FIELD_SIZE must be a positive integer',
+                self.extension_module.setup_limit_request_field_size, ctx)
+
+    def _render_deflate_conf(self, ctx):
+        cfg = os.path.join(self.build_dir, 'httpd-deflate.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-deflate.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return f.read().split('\n')
+
+    def test_deflate_defaults(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_deflate(ctx)
+        lines = self._render_deflate_conf(ctx)
+        assert 'AddOutputFilterByType DEFLATE text/html text/plain ' \
+            'text/xml text/css text/javascript application/javascript' in lines
+        assert 'DeflateCompressionLevel 6' in lines
+
+    def test_deflate_min_length_and_level(self):
+        ctx = utils.FormattedDict({'DEFLATE_MIN_LENGTH': '1024',
+                                   'DEFLATE_COMPRESSION_LEVEL': 4})
+        self.extension_module.setup_deflate(ctx)
+        lines = self._render_deflate_conf(ctx)
+        assert 'DeflateCompressionLevel 4' in lines
+        assert 'FilterProvider COMPRESS DEFLATE "%{CONTENT_TYPE} =~ ' \
+            'm#^(text/html|text/plain|text/xml|text/css|text/javascript|' \
+            'application/javascript)# && (-z resp(\'Content-Length\') || ' \
+            'resp(\'Content-Length\') -ge 1024)"' in lines
+        assert 'FilterChain COMPRESS' in lines
+        eq_([], [line for line in lines if 'AddOutputFilterByType' in line])
+
+    def test_deflate_invalid(self):
+        ctx = utils.FormattedDict({'DEFLATE_COMPRESSION_LEVEL': 10})
+        assert_raises_regexp(RuntimeError,
+                             'DEFLATE_COMPRESSION_LEVEL must be between 1',
+                             self.extension_module.setup_deflate, ctx)
+        ctx = utils.FormattedDict({'DEFLATE_MIN_LENGTH': '-1'})
+        assert_raises_regexp(RuntimeError,
+                             'DEFLATE_MIN_LENGTH must be a number of bytes',
+                             self.extension_module.setup_deflate, ctx)
+
+    def test_timeout_must_be_positive(self):
+        ctx = utils.FormattedDict({'HTTPD_TIMEOUT': 0})
+        assert_raises_regexp(RuntimeError,
+                             'HTTPD_TIMEOUT must be a positive integer',
+                             self.extension_module.setup_timeout, ctx)
+
+    def test_start_servers(self):
+        ctx = utils.FormattedDict({'HTTPD_START_SERVERS': '8'})
+        self.extension_module.setup_start_servers(ctx)
+        cfg = os.path.join(self.build_dir, 'httpd-mpm.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-mpm.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            s = f.read()
+        eq_(2, s.count('    StartServers             8\n'))
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_start_servers(ctx)
+        eq_(3, ctx['HTTPD_START_SERVERS'])
+
+    def test_start_servers_must_be_within_mpm_limits(self):
+        for start in (0, 17, 'many'):
+            ctx = utils.FormattedDict({'HTTPD_START_SERVERS': start})
+            assert_raises_regexp(RuntimeError,
+                                 'HTTPD_START_SERVERS must be an integer',
+                                 self.extension_module.setup_start_servers,
+                                 ctx)
+
+    def test_threads_per_child(self):
+        ctx = utils.FormattedDict({'HTTPD_THREADS_PER_CHILD': '50',
+                                   'HTTPD_START_SERVERS': 3})
+        eq_([], self.extension_module.setup_threads_per_child(ctx))
+        cfg = os.path.join(self.build_dir, 'httpd-mpm.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-mpm.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            s = f.read()
+        eq_(2, s.count('    ThreadsPerChild         50\n'))
+        ctx = utils.FormattedDict({})
+        eq_([], self.extension_module.setup_threads_per_child(ctx))
+        eq_(25, ctx['HTTPD_THREADS_PER_CHILD'])
+
+    def test_threads_per_child_incoherent(self):
+        for threads in (10, 30, 100):
+            ctx = utils.FormattedDict({'HTTPD_THREADS_PER_CHILD': threads})
+            warnings = self.extension_module.setup_threads_per_child(ctx)
+            eq_(1, len(warnings), warnings)
+        ctx = utils.FormattedDict({'HTTPD_THREADS_PER_CHILD': 40,
+                                   'HTTPD_START_SERVERS': 16})
+        warnings = self.extension_module.setup_threads_per_child(ctx)
+        assert 'more threads than MaxRequestWorkers' in warnings[0]
+
+    def test_threads_per_child_must_be_positive(self):
+        for threads in (0, 'lots'):
+            ctx = utils.FormattedDict({'HTTPD_THREADS_PER_CHILD': threads})
+            assert_raises_regexp(
+                RuntimeError,
+                'HTTPD_THREADS_PER_CHILD must be a positive integer',
+                self.extension_module.setup_threads_per_child, ctx)
+
+    def test_allowed_methods_not_set(self):
+        ctx = utils.FormattedDict({})
+        self.extension_module.setup_allowed_methods(ctx)
+        eq_('', ctx['HTTPD_ALLOWED_METHODS'])
+        eq_('off', ctx['HTTPD_TRACE_ENABLE'])
+
+    def test_allowed_methods_block_others(self):
+        ctx = utils.FormattedDict({
+            'ALLOWED_METHODS': ['GET', 'post', 'HEAD']
+        })
+        self.extension_module.setup_allowed_methods(ctx)
+        for name in ('httpd-rewrite.conf', 'httpd-default.conf'):
+            shutil.copy(os.path.join('defaults/config/httpd/extra', name),
+                        self.build_dir)
+        ctx['REWRITE_RULES'] = []
+        self.extension_module.setup_rewrite_rules(ctx)
+        ctx['HTTPD_TIMEOUT'] = 65
+        utils.rewrite_cfgs(self.build_dir, ctx, delim='#')
+        with open(os.path.join(self.build_dir, 'httpd-rewrite.conf')) as f:
+            lines = f.read().split('\n')
+        assert 'RewriteCond %{REQUEST_METHOD} !^(GET|POST|HEAD)$' in lines
+        assert 'RewriteRule .* - [R=405,L]' in lines
+        with open(os.path.join(self.build_dir, 'httpd-default.conf')) as f:
+            assert '\nTraceEnable off\n' in f.read()
+
+    def test_allowed_methods_with_trace(self):
+        ctx = utils.FormattedDict({'ALLOWED_METHODS': ['GET', 'TRACE']})
+        self.extension_module.setup_allowed_methods(ctx)
+        eq_('on', ctx['HTTPD_TRACE_ENABLE'])
+
+    def test_allowed_methods_must_be_method_names(self):
+        ctx = utils.FormattedDict({'ALLOWED_METHODS': ['GET|.*']})
+        assert_raises_regexp(RuntimeError,
+                             'ALLOWED_METHODS must be HTTP method names',
+                             self.extension_module.setup_allowed_methods, ctx)
+
+    def _render_directories(self, ctx):
+        cfg = os.path.join(self.build_dir, 'httpd-directories.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-directories.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return f.read().split('\n')
+
+    def test_allow_override(self):
+        for allow, expected in ((None, 'None'), (False, 'None'),
+                                (True, 'All'), ('false', 'None'),
+                                ('true', 'All'),
+                                (['FileInfo', 'Options'], 'FileInfo Options')):
+            ctx = utils.FormattedDict({'WEBDIR': 'htdocs'})
+            if allow is not None:
+                ctx['ALLOW_HTACCESS'] = allow
+            self.extension_module.setup_allow_override(ctx)
+            lines = [line.strip() for line in self._render_directories(ctx)]
+            eq_(['AllowOverride none', 'AllowOverride %s' % expected],
+                [line for line in lines if line.startswith('AllowOverride')])
+
+    def test_allow_override_invalid(self):
+        ctx = utils.FormattedDict({'ALLOW_HTACCESS': ['Everything']})
+        assert_raises_regexp(RuntimeError,
+                             'ALLOW_HTACCESS must be true, false or a list',
+                             self.extension_module.setup_allow_override, ctx)
+
+    def _render_php_conf(self, ctx):
+        cfg = os.path.join(self.build_dir, 'httpd-php.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-php.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            return f.read().split('\n')
+
+    def test_directory_index_default(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'htdocs'})
+        self.extension_module.setup_directory_index(ctx)
+        lines = self._render_php_conf(ctx)
+        eq_('DirectoryIndex index.php index.html index.htm', lines[0])
+
+    def test_directory_index_detects_front_controller(self):
+        webdir = os.path.join(self.build_dir, 'public')
+        os.makedirs(webdir)
+        open(os.path.join(webdir, 'app.php'), 'w').close()
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'public'})
+        self.extension_module.setup_directory_index(ctx)
+        lines = self._render_php_conf(ctx)
+        eq_('DirectoryIndex app.php index.php index.html index.htm', lines[0])
+
+    def test_directory_index_configured_front_controller(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'public',
+                                   'FALLBACK_TO_FRONT_CONTROLLER': '/api.php'})
+        self.extension_module.setup_directory_index(ctx)
+        lines = self._render_php_conf(ctx)
+        eq_('DirectoryIndex api.php index.php index.html index.htm', lines[0])
+        ctx['FRONT_CONTROLLER'] = 'index.php'
+        self.extension_module.setup_directory_index(ctx)
+        lines = self._render_php_conf(ctx)
+        eq_('DirectoryIndex index.php index.html index.htm', lines[0])
+
+    def test_php_proxy_flush(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'PHP_FPM_LISTEN': '127.0.0.1:9000'})
+        self.extension_module.setup_php_proxy_flush(ctx)
+        self.extension_module.setup_php_files_match(ctx)
+        self.extension_module.setup_php_retry(ctx)
+        lines = self._render_php_conf(ctx)
+        assert '    ProxySet disablereuse=On retry=0 flushpackets=off' \
+            in lines
+        ctx['PHP_OUTPUT_BUFFERING'] = 'off'
+        ctx['RETRY_ON_FPM_ERROR'] = True
+        self.extension_module.setup_php_proxy_flush(ctx)
+        self.extension_module.setup_php_retry(ctx)
+        lines = self._render_php_conf(ctx)
+        assert '    ProxySet disablereuse=On retry=0 flushpackets=on' in lines
+        assert '    BalancerMember "fcgi://127.0.0.1:9000" retry=0 ' \
+            'disablereuse=On flushpackets=on' in lines
+
+    def test_proxy_error_override(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'PHP_FPM_LISTEN': '127.0.0.1:9000'})
+        self.extension_module.setup_proxy_error_override(ctx)
+        assert 'ProxyErrorOverride Off' in self._render_php_conf(ctx)
+        ctx['PROXY_ERROR_OVERRIDE'] = True
+        self.extension_module.setup_proxy_error_override(ctx)
+        assert 'ProxyErrorOverride On' in self._render_php_conf(ctx)
+
+    def test_php_files_match_default(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'PHP_FPM_LISTEN': '127.0.0.1:9000'})
+        self.extension_module.setup_php_files_match(ctx)
+        self.extension_module.setup_php_retry(ctx)
+        lines = self._render_php_conf(ctx)
+        assert '  <FilesMatch "\\.(php)$">' in lines
+
+    def test_php_files_match_configured(self):
+        ctx = utils.FormattedDict({
+            'WEBDIR': 'htdocs',
+            'PHP_FPM_LISTEN': '127.0.0.1:9000',
+            'PHP_FILE_EXTENSIONS': ['.php', '.phtml', 'php5']
+        })
+        self.extension_module.setup_php_files_match(ctx)
+        self.extension_module.setup_php_retry(ctx)
+        lines = self._render_php_conf(ctx)
+        assert '  <FilesMatch "\\.(php|phtml|php5)$">' in lines
+
+    def test_php_retry_disabled(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'PHP_FPM_LISTEN': '127.0.0.1:9000'})
+        self.extension_module.setup_php_files_match(ctx)
+        self.extension_module.setup_php_retry(ctx)
+        lines = [line.strip() for line in self._render_php_conf(ctx)]
+        assert 'SetHandler proxy:fcgi://127.0.0.1:9000' in lines
+        eq_([], [line for line in lines if 'balancer' in line])
+
+    def test_php_retry_enabled(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'PHP_FPM_LISTEN': '127.0.0.1:9000',
+                                   'RETRY_ON_FPM_ERROR': True})
+        self.extension_module.setup_php_files_match(ctx)
+        self.extension_module.setup_php_retry(ctx)
+        lines = [line.strip() for line in self._render_php_conf(ctx)]
+        assert 'SetHandler proxy:balancer://php-fpm' in lines
+        assert 'LoadModule proxy_balancer_module ' \
+            'modules/mod_proxy_balancer.so' in lines
+        assert '<Proxy "balancer://php-fpm">' in lines
+        assert 'BalancerMember "fcgi://127.0.0.1:9000" retry=0 ' \
+            'disablereuse=On' in lines
+        assert 'ProxySet maxattempts=3 failonstatus=503 ' \
+            'forcerecovery=On' in lines
+
+    def test_directory_listing_disabled_by_default(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs'})
+        self.extension_module.setup_directory_listing(ctx)
+        lines = self._render_directories(ctx)
+        assert '    Options -Indexes' in lines
+        assert '  LoadModule autoindex_module modules/mod_autoindex.so' \
+            not in lines
+
+    def test_directory_listing_allowed(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'ALLOW_DIRECTORY_LISTING': True})
+        self.extension_module.setup_directory_listing(ctx)
+        lines = self._render_directories(ctx)
+        assert '    Options -Indexes' not in lines
+        assert '    Options +Indexes' in lines
+        assert '  LoadModule autoindex_module modules/mod_autoindex.so' in lines
+
+    def test_static_assets_favicon_204_by_default(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'htdocs'})
+        self.extension_module.setup_static_assets(ctx)
+        eq_('Redirect 204 /favicon.ico',
+            ctx['HTTPD_STATIC_ASSETS'].split('\n')[-1])
+        os.makedirs(os.path.join(self.build_dir, 'htdocs'))
+        open(os.path.join(self.build_dir, 'htdocs', 'favicon.ico'), 'w').close()
+        self.extension_module.setup_static_assets(ctx)
+        eq_('', ctx['HTTPD_STATIC_ASSETS'])
+
+    def test_static_assets(self):
+        os.makedirs(os.path.join(self.build_dir, 'assets'))
+        with open(os.path.join(self.build_dir, 'assets', 'icon.png'), 'w') as f:
+            f.write('png')
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'WEBDIR': 'htdocs',
+            'ROBOTS_TXT': 'User-agent: *\nDisallow: /admin/\n',
+            'FAVICON': 'assets/icon.png'
+        })
+        self.extension_module.setup_static_assets(ctx)
+        lines = self._render_directories(ctx)
+        assert 'Alias "/robots.txt" "${HOME}/.bp/static/robots.txt"' in lines
+        assert 'Alias "/favicon.ico" "${HOME}/.bp/static/favicon.png"' in lines
+        assert '    ForceType text/plain' in lines
+        assert '    ForceType image/png' in lines
+        assert '<Directory "${HOME}/.bp/static">' in lines
+        assert 'Redirect 204 /favicon.ico' not in lines
+        static_dir = os.path.join(self.build_dir, '.bp', 'static')
+        with open(os.path.join(static_dir, 'robots.txt')) as f:
+            eq_('User-agent: *\nDisallow: /admin/\n', f.read())
+        with open(os.path.join(static_dir, 'favicon.png')) as f:
+            eq_('png', f.read())
+
+    def test_static_assets_favicon_must_exist(self):
+        ctx = utils.FormattedDict({'BUILD_DIR': self.build_dir,
+                                   'WEBDIR': 'htdocs',
+                                   'FAVICON': 'missing.ico'})
+        assert_raises_regexp(RuntimeError, 'FAVICON must be a file',
+                             self.extension_module.setup_static_assets, ctx)
+
+    def test_base_path_not_set(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs'})
+        self.extension_module.setup_base_path(ctx)
+        eq_('', ctx['HTTPD_BASE_PATH'])
+
+    def test_base_path(self):
+        ctx = utils.FormattedDict({
+            'WEBDIR': 'htdocs',
+            'BASE_PATH': '/myapp/',
+            'FALLBACK_TO_FRONT_CONTROLLER': True
+        })
+        self.extension_module.setup_base_path(ctx)
+        self.extension_module.setup_fallback_resource(ctx)
+        cfg = os.path.join(self.build_dir, 'httpd-directories.conf')
+        shutil.copy('defaults/config/httpd/extra/httpd-directories.conf', cfg)
+        utils.rewrite_cfgs(cfg, ctx, delim='#')
+        with open(cfg) as f:
+            lines = f.read().split('\n')
+        assert '  LoadModule alias_module modules/mod_alias.so' in lines
+        assert 'Alias "/myapp" "${HOME}/htdocs"' in lines
+        assert 'SetEnv BASE_PATH "/myapp"' in lines
+        assert '    FallbackResource /myapp/index.php' in lines
+
+    def test_base_path_must_be_url_path(self):
+        ctx = utils.FormattedDict({'WEBDIR': 'htdocs',
+                                   'BASE_PATH': 'myapp"'})
+        assert_raises_regexp(RuntimeError, 'BASE_PATH must be a URL path',
+                             self.extension_module.setup_base_path, ctx)
@@ -0,0 +1,261 @@
+import os
+import tempfile
+import shutil
+from dingus import Dingus
+from common.dingus_extension import patches
+from nose.tools import eq_
+from nose.tools import assert_raises_regexp
+from build_pack_utils import utils
+
+
+class TestPHPExtension(object):
+    def setUp(self):
+        self.build_dir = tempfile.mkdtemp(prefix='build-')
+        self.extension_module = utils.load_extension('lib/php')
+
+    def tearDown(self):
+        if os.path.exists(self.build_dir):
+            shutil.rmtree(self.build_dir)
+
+    def _ctx(self, **kwargs):
+        ctx = utils.FormattedDict({
+            'BUILD_DIR': self.build_dir,
+            'PHP_VM': 'php',
+            'PHP_VERSION': '5.6.34',
+            'PHP_STRIP': True,
+            'ALL_PHP_VERSIONS': ['5.6.34', '7.1.15', '7.2.3']
+        })
+        ctx.update(kwargs)
+        return ctx
+
+    def _compile(self, ctx):
+        """Run _compile with the steps which need a real PHP stubbed out"""
+        install = Dingus()
+        install.builder._ctx = ctx
+        with patches({
+            'php.extension.validate_php_version': Dingus(),
+            'php.extension.setup_grpc_extensions': Dingus(),
+            'php.extension.needs_sodium_module': Dingus(return_value=False),
+            'php.extension.validate_php_ini_extensions': Dingus(),
+            'php.extension.validate_php_extensions': Dingus(),
+            'php.extension.link_php_extension_lib_dirs': Dingus(),
+            'php.extension.convert_php_extensions': Dingus(),
+            'php.extension.include_fpm_d_confs': Dingus(),
+            'php.extension.setup_php_ini_options': Dingus(),
+            'php.extension.setup_fpm_pool_options': Dingus(),
+            'php.extension.check_memory_limit': Dingus()
+        }):
+            php = self.extension_module.PHPExtension(ctx)
+            eq_(0, php._compile(install))
+        return install
+
+    def test_compile_blocks_extensions_added_while_compiling(self):
+        ctx = self._ctx(WEBDIR='htdocs',
+                        BP_ENV='staging',
+                        PHP_EXTENSIONS=['bz2'],
+                        ZEND_EXTENSIONS=[],
+                        MEMORY_PROFILING=True,
+                        XDEBUG={'enabled': True},
+                        EXTENSION_BLOCKLIST='xdebug')
+        self._compile(ctx)
+        eq_(['bz2'], ctx['PHP_EXTENSIONS'])
+        eq_([], ctx['ZEND_EXTENSIONS'])
+
+    def test_install_php_cli_when_version_differs(self):
+        ctx = self._ctx(WEBDIR='htdocs',
+                        PHP_EXTENSIONS=[],
+                        ZEND_EXTENSIONS=[],
+                        PHP_CLI_VERSION='7.2.3')
+        install = self._compile(ctx)
+        packages = [c.args[0] for c in install.calls('package')]
+        eq_(['PHP', 'PHP_CLI'], packages)
+        eq_('/php/7.2.3/php-7.2.3.tar.gz', ctx['PHP_CLI_DOWNLOAD_URL'])
+        eq_('php-cli', ctx['PHP_CLI_PACKAGE_INSTALL_DIR'])
+        eq_(True, ctx['PHP_CLI_STRIP'])
+        wrapper = os.path.join(self.build_dir, 'php-cli', 'wrapper', 'php')
+        eq_(True, os.access(wrapper, os.X_OK))
+        with open(wrapper) as f:
+            script = f.read()
+        assert '-c "$HOME/php-cli/etc"' in script
+        assert 'export PHP_INI_SCAN_DIR="$HOME/php-cli/etc/php.ini.d/"' in \
+            script, script
+
+    def test_install_php_cli_own_php_ini_d(self):
+        ctx = self._ctx(WEBDIR='htdocs',
+                        PHP_EXTENSIONS=['redis', 'custom'],
+                        ZEND_EXTENSIONS=[],
+                        EXTENSION_DIRS=['ext'],
+                        EXTENSION_PRIORITIES={'redis': 20, 'custom': 30},
+                        PHP_INI_SCAN_DIRS=['config/php'],
+                        PHP_CLI_VERSION='7.2.3',
+                        FILE_UMASK='0027')
+        os.makedirs(os.path.join(self.build_dir, 'ext'))
+        open(os.path.join(self.build_dir, 'ext', 'custom.so'), 'w').close()
+        self._compile(ctx)
+        cli_ini_d = os.path.join(self.build_dir, 'php-cli', 'etc',
+                                 'php.ini.d')
+        # custom.so in the app is built for the web PHP
+        eq_(['20-redis.ini'], os.listdir(cli_ini_d))
+        wrapper = os.path.join(self.build_dir, 'php-cli', 'wrapper', 'php')
+        with open(wrapper) as f:
+            assert 'export PHP_INI_SCAN_DIR="$HOME/php-cli/etc/php.ini.d/:' \
+                '$HOME/config/php"' in f.read()
+        eq_(0750, os.stat(wrapper).st_mode & 0777)
+
+    def test_install_php_cli_same_version(self):
+        ctx = self._ctx(PHP_CLI_VERSION='5.6.34')
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_php_cli(install)
+        eq_(0, len(install.calls('package')))
+        assert 'PHP_CLI_DOWNLOAD_URL' not in ctx
+
+    def test_install_php_cli_not_set(self):
+        ctx = self._ctx()
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_php_cli(install)
+        eq_(0, len(install.calls('package')))
+
+    def test_service_environment_with_php_cli(self):
+        ctx = self._ctx(PHP_EXTENSIONS=[],
+                        PHP_CLI_INSTALL_PATH='php-cli')
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('$HOME/php-cli/wrapper:$PATH:$HOME/php/bin:$HOME/php/sbin',
+            env['PATH'])
+        eq_('$HOME/php/etc', env['PHPRC'])
+
+    def test_service_environment_locale(self):
+        ctx = self._ctx(PHP_EXTENSIONS=[])
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('C.UTF-8', env['LANG'])
+        eq_('C.UTF-8', env['LC_ALL'])
+        ctx = self._ctx(PHP_EXTENSIONS=[], DEFAULT_LOCALE='de_DE.UTF-8')
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('de_DE.UTF-8', env['LANG'])
+        eq_('de_DE.UTF-8', env['LC_ALL'])
+
+    def test_service_environment_php_ini_scan_dir(self):
+        ctx = self._ctx(PHP_EXTENSIONS=[])
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        assert 'PHP_INI_SCAN_DIR' not in env
+        os.makedirs(os.path.join(self.build_dir, 'php', 'etc', 'php.ini.d'))
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('$HOME/php/etc/php.ini.d/', env['PHP_INI_SCAN_DIR'])
+
+    def test_service_environment_php_ini_scan_dirs(self):
+        ctx = self._ctx(PHP_EXTENSIONS=[],
+                        PHP_INI_SCAN_DIRS=['config/php', '$HOME/overrides'])
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('$HOME/php/etc/php.ini.d/:$HOME/config/php:$HOME/overrides',
+            env['PHP_INI_SCAN_DIR'])
+        ctx = self._ctx(PHP_EXTENSIONS=[], PHP_INI_SCAN_DIRS=['a:b'])
+        assert_raises_regexp(
+            RuntimeError, 'PHP_INI_SCAN_DIRS must be paths in the app',
+            self.extension_module.PHPExtension(ctx)._service_environment)
+
+    def test_service_environment_template_env(self):
+        ctx = self._ctx(PHP_EXTENSIONS=[])
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        assert 'TEMPLATE_ENV' not in env
+        ctx = self._ctx(PHP_EXTENSIONS=[], TEMPLATE_ENV=['API_HOST', 'MY_VAR'])
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('API_HOST:MY_VAR', env['TEMPLATE_ENV'])
+        ctx = self._ctx(PHP_EXTENSIONS=[], TEMPLATE_ENV='API_HOST, MY_VAR')
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('API_HOST:MY_VAR', env['TEMPLATE_ENV'])
+        ctx = self._ctx(PHP_EXTENSIONS=[], TEMPLATE_ENV=['MY-VAR'])
+        assert_raises_regexp(
+            RuntimeError, 'TEMPLATE_ENV must list environment variable names',
+            self.extension_module.PHPExtension(ctx)._service_environment)
+
+    def test_preprocess_commands_upload_tmp_dir(self):
+        ctx = self._ctx()
+        php = self.extension_module.PHPExtension(ctx)
+        eq_((('$HOME/.bp/bin/rewrite', '"$HOME/php/etc"'),),
+            php._preprocess_commands())
+        ctx['UPLOAD_TMP_DIR'] = '@{HOME}/../uploads'
+        commands = php._preprocess_commands()
+        eq_(('mkdir', '-p', '"${HOME}/../uploads"'), commands[1])
+        eq_('find', commands[3][0])
+        eq_('"${HOME}/../uploads"', commands[3][1])
+
+    def test_service_environment_otel_resource_attributes(self):
+        ctx = self._ctx(PHP_EXTENSIONS=[])
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        assert 'OTEL_RESOURCE_ATTRIBUTES' not in env
+        ctx = self._ctx(
+            PHP_EXTENSIONS=[],
+            VCAP_APPLICATION={'application_name': 'my-app',
+                              'application_version': 'abc-123'},
+            OTEL={'environment': 'staging',
+                  'attributes': {'service.namespace': 'shop team'}})
+        env = self.extension_module.PHPExtension(ctx)._service_environment()
+        eq_('"service.name=my-app,service.version=abc-123,'
+            'deployment.environment=staging,'
+            'service.namespace=shop%20team"',
+            env['OTEL_RESOURCE_ATTRIBUTES'])
+
+    def test_install_php_from_manifest(self):
+        ctx = self._ctx()
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_php(install)
+        eq_(['PHP'], [c.args[0] for c in install.calls('package')])
+        eq_(0, len(install._installer.calls('install_binary_verified')))
+
+    def test_install_php_dependency_override(self):
+        sha256 = 'a' * 64
+        ctx = self._ctx(
+            BP_PHP_DEPENDENCY_OVERRIDE='true',
+            PHP_DEPENDENCY_URI='https://php.example.com/php-5.6.34.tgz',
+            PHP_DEPENDENCY_SHA256=sha256)
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_php(install)
+        eq_(0, len(install.calls('package')))
+        calls = install._installer.calls('install_binary_verified')
+        eq_(1, len(calls))
+        eq_(('https://php.example.com/php-5.6.34.tgz', sha256,
+             os.path.join(self.build_dir, 'php')), calls[0].args)
+        eq_(True, calls[0].kwargs['strip'])
+
+    def test_install_php_dependency_override_requires_sha256(self):
+        ctx = self._ctx(
+            BP_PHP_DEPENDENCY_OVERRIDE='true',
+            PHP_DEPENDENCY_URI='https://php.example.com/php-5.6.34.tgz')
+        install = Dingus()
+        install.builder._ctx = ctx
+        assert_raises_regexp(
+            RuntimeError, 'PHP_DEPENDENCY_SHA256',
+            self.extension_module.PHPExtension(ctx)._install_php, install)
+
+    def test_install_sodium_php_71(self):
+        ctx = self._ctx(PHP_VERSION='7.1.15',
+                        PHP_EXTENSIONS=['bz2', 'sodium'])
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_sodium(install)
+        eq_(1, len(install.calls('modules')))
+        eq_('PHP', install.calls('modules')[0].args[0])
+        include_calls = install.calls('modules').one().return_value \
+            .calls('include_module')
+        eq_(1, len(include_calls))
+        eq_('sodium', include_calls[0].args[0])
+        assert 'sodium' in ctx['PHP_EXTENSIONS']
+
+    def test_install_sodium_php_72(self):
+        ctx = self._ctx(PHP_VERSION='7.2.3',
+                        PHP_EXTENSIONS=['bz2', 'sodium'])
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_sodium(install)
+        eq_(0, len(install.calls('modules')))
+        assert 'sodium' in ctx['PHP_EXTENSIONS']
+
+    def test_install_sodium_not_requested(self):
+        ctx = self._ctx(PHP_VERSION='7.1.15', PHP_EXTENSIONS=['bz2'])
+        install = Dingus()
+        install.builder._ctx = ctx
+        self.extension_module.PHPExtension(ctx)._install_sodium(install)
+        eq_(0, len(install.calls('modules')))
@@ -1,11 +1,437 @@
 import os
+import json
+import shutil
+import tempfile
+from nose.tools import eq_
+from nose.tools import assert_raises_regexp
+from dingus import Dingus
+from dingus import patch
+from build_pack_utils import utils
+from compile_helpers import setup_php_ini_options
+from compile_helpers import setup_fpm_pool_options
 
 
 class TestPHPConfigFiles(object):
+    def setUp(self):
+        self.config_dir = tempfile.mkdtemp(prefix='config-')
+
+    def tearDown(self):
+        if os.path.exists(self.config_dir):
+            shutil.rmtree(self.config_dir)
+
+    def render_php_ini(self, version_dir, ctx):
+        ini_file = os.path.join(self.config_dir, 'php.ini')
+        shutil.copy(os.path.join('defaults/config/php', version_dir, 'php.ini'),
+                    ini_file)
+        setup_php_ini_options(ctx)
+        utils.rewrite_cfgs(ini_file, ctx, delim='#')
+        with open(ini_file) as f:
+            return f.read()
+
+    def render_php_fpm_conf(self, version_dir, ctx):
+        fpm_file = os.path.join(self.config_dir, 'php-fpm.conf')
+        shutil.copy(os.path.join('defaults/config/php', version_dir,
+                                 'php-fpm.conf'),
+                    fpm_file)
+        setup_fpm_pool_options(ctx)
+        utils.rewrite_cfgs(fpm_file, ctx, delim='#')
+        with open(fpm_file) as f:
+            return f.read()
+
+    def load_default_options(self):
+        with open('defaults/options.json') as f:
+            return utils.FormattedDict(json.load(f))
+
     def test_disables_expose_php(self):
         php_config_dir = 'defaults/config/php'
         for version_dir in os.listdir(php_config_dir):
-            ini_file = os.path.join(php_config_dir, version_dir, 'php.ini')
-            with open(ini_file) as f:
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert 'expose_php = Off' in s
+
+    def test_enables_expose_php(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir,
+                                    utils.FormattedDict({'EXPOSE_PHP': True}))
+            assert 'expose_php = On' in s
+
+    def test_appends_php_ini_directives(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_INI_DIRECTIVES'] = {
+                'memory_limit': '512M',
+                'display_errors': True,
+                'date.timezone': 'UTC',
+                'bad directive': 'x'
+            }
+            s = self.render_php_ini(version_dir, options)
+            lines = s.split('\n')
+            memory_limits = [l for l in lines if l.startswith('memory_limit')]
+            eq_(['memory_limit = 128M', 'memory_limit = 512M'], memory_limits)
+            assert 'display_errors = On' in lines
+            assert 'date.timezone = UTC' in lines
+            assert 'bad directive' not in s
+            assert lines.index('memory_limit = 512M') > \
+                lines.index('expose_php = Off')
+
+    def test_resource_limits(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\nmax_execution_time = 30\n' in s
+            assert '\nmax_input_vars = 1000\n' in s
+            options = self.load_default_options()
+            options['PHP_MAX_EXECUTION_TIME'] = 120
+            options['PHP_MAX_INPUT_VARS'] = '5000'
+            s = self.render_php_ini(version_dir, options)
+            assert '\nmax_execution_time = 120\n' in s
+            assert '\nmax_input_vars = 5000\n' in s
+
+    def test_session_gc(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\nsession.gc_maxlifetime = 1440\n' in s
+            assert '\nsession.gc_probability = 1\n' in s
+            assert '\nsession.gc_divisor = 100\n' in s
+            options = self.load_default_options()
+            options['PHP_SESSION_GC_MAXLIFETIME'] = 7200
+            options['PHP_SESSION_GC_PROBABILITY'] = '5'
+            options['PHP_SESSION_GC_DIVISOR'] = 1000
+            s = self.render_php_ini(version_dir, options)
+            assert '\nsession.gc_maxlifetime = 7200\n' in s
+            assert '\nsession.gc_probability = 5\n' in s
+            assert '\nsession.gc_divisor = 1000\n' in s
+
+    def test_session_gc_divisor_must_be_positive(self):
+        options = self.load_default_options()
+        options['PHP_SESSION_GC_DIVISOR'] = 0
+        assert_raises_regexp(RuntimeError,
+                             'PHP_SESSION_GC_DIVISOR must be greater than 0',
+                             setup_php_ini_options, options)
+
+    def test_upload_tmp_dir(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\nupload_tmp_dir = "@{TMPDIR}"\n' in s
+            options = self.load_default_options()
+            options['UPLOAD_TMP_DIR'] = '@{HOME}/../uploads'
+            s = self.render_php_ini(version_dir, options)
+            assert '\nupload_tmp_dir = "@{HOME}/../uploads"\n' in s
+
+    def test_upload_tmp_dir_must_be_a_path(self):
+        options = self.load_default_options()
+        options['UPLOAD_TMP_DIR'] = 'uploads'
+        assert_raises_regexp(RuntimeError,
+                             'UPLOAD_TMP_DIR must be an absolute path',
+                             setup_php_ini_options, options)
+
+    def test_assertions(self):
+        for version_dir in ('7.0.x', '7.1.x', '7.2.x'):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\nzend.assertions = -1\n' in s
+            assert '\nassert.exception = On\n' in s
+            options = self.load_default_options()
+            options['BP_ENV'] = 'staging'
+            s = self.render_php_ini(version_dir, options)
+            assert '\nzend.assertions = 1\n' in s
+            options['PHP_ZEND_ASSERTIONS'] = 0
+            options['PHP_ASSERT_EXCEPTION'] = False
+            s = self.render_php_ini(version_dir, options)
+            assert '\nzend.assertions = 0\n' in s
+            assert '\nassert.exception = Off\n' in s
+
+    def test_assertions_must_be_valid(self):
+        options = self.load_default_options()
+        options['PHP_ZEND_ASSERTIONS'] = 2
+        assert_raises_regexp(RuntimeError,
+                             'PHP_ZEND_ASSERTIONS must be -1, 0 or 1',
+                             setup_php_ini_options, options)
+
+    def test_default_socket_timeout(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\ndefault_socket_timeout = 60\n' in s
+            options = self.load_default_options()
+            options['DEFAULT_SOCKET_TIMEOUT'] = '5'
+            s = self.render_php_ini(version_dir, options)
+            assert '\ndefault_socket_timeout = 5\n' in s
+
+    def test_output_buffering_and_implicit_flush(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\noutput_buffering = 4096\n' in s
+            assert '\nimplicit_flush = Off\n' in s
+            options = self.load_default_options()
+            options['PHP_OUTPUT_BUFFERING'] = False
+            options['PHP_IMPLICIT_FLUSH'] = True
+            s = self.render_php_ini(version_dir, options)
+            assert '\noutput_buffering = Off\n' in s
+            assert '\nimplicit_flush = On\n' in s
+
+    def test_output_buffering_must_be_valid(self):
+        options = self.load_default_options()
+        options['PHP_OUTPUT_BUFFERING'] = '4k'
+        assert_raises_regexp(RuntimeError,
+                             'PHP_OUTPUT_BUFFERING must be `on`, `off` or a '
+                             'size in bytes',
+                             setup_php_ini_options, options)
+
+    def test_zlib_output_compression(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\nzlib.output_compression = Off\n' in s
+            assert '\n;zlib.output_compression_level = -1\n' in s
+            options = self.load_default_options()
+            options['ZLIB_OUTPUT_COMPRESSION'] = 6
+            s = self.render_php_ini(version_dir, options)
+            assert '\nzlib.output_compression = On\n' in s
+            assert '\nzlib.output_compression_level = 6\n' in s
+
+    def test_zlib_output_compression_warns_about_double_compression(self):
+        log = Dingus()
+        with patch('compile_helpers._log', log):
+            options = self.load_default_options()
+            setup_php_ini_options(options)
+            eq_(0, len(log.calls('warning')))
+            options['ZLIB_OUTPUT_COMPRESSION'] = True
+            setup_php_ini_options(options)
+            eq_(1, len(log.calls('warning')))
+            assert 'httpd compresses responses as well (with mod_deflate)' \
+                in log.calls('warning')[0].args[0]
+
+    def test_default_socket_timeout_must_be_positive(self):
+        options = self.load_default_options()
+        options['DEFAULT_SOCKET_TIMEOUT'] = 0
+        assert_raises_regexp(RuntimeError,
+                             'DEFAULT_SOCKET_TIMEOUT must be greater than 0',
+                             setup_php_ini_options, options)
+
+    def test_resource_limits_must_be_non_negative_integers(self):
+        for key, val in (('PHP_MAX_EXECUTION_TIME', -1),
+                         ('PHP_MAX_INPUT_VARS', 'lots')):
+            options = self.load_default_options()
+            options[key] = val
+            assert_raises_regexp(RuntimeError,
+                                 '%s must be a non-negative integer' % key,
+                                 setup_php_ini_options, options)
+
+    def test_intl_default_locale(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\n;intl.default_locale =\n' in s
+            options = self.load_default_options()
+            options['PHP_EXTENSIONS'] = ['intl']
+            s = self.render_php_ini(version_dir, options)
+            assert '\nintl.default_locale = C.UTF-8\n' in s
+            options['DEFAULT_LOCALE'] = 'de_DE.UTF-8'
+            s = self.render_php_ini(version_dir, options)
+            assert '\nintl.default_locale = de_DE.UTF-8\n' in s
+
+    def test_soap_wsdl_cache(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            s = self.render_php_ini(version_dir, self.load_default_options())
+            assert '\nsoap.wsdl_cache_dir' not in s
+            assert '\nsoap.wsdl_cache_ttl' not in s
+            options = self.load_default_options()
+            options['PHP_EXTENSIONS'] = ['soap']
+            s = self.render_php_ini(version_dir, options)
+            assert '\nsoap.wsdl_cache_dir="@{TMPDIR}"\n' in s
+            assert '\nsoap.wsdl_cache_ttl=86400\n' in s
+            options['SOAP_WSDL_CACHE_DIR'] = '@{HOME}/wsdl-cache'
+            options['SOAP_WSDL_CACHE_TTL'] = 3600
+            s = self.render_php_ini(version_dir, options)
+            assert '\nsoap.wsdl_cache_dir="@{HOME}/wsdl-cache"\n' in s
+            assert '\nsoap.wsdl_cache_ttl=3600\n' in s
+
+    def test_default_locale_must_be_valid(self):
+        options = self.load_default_options()
+        options['DEFAULT_LOCALE'] = 'en_US; rm -rf /'
+        assert_raises_regexp(RuntimeError,
+                             'DEFAULT_LOCALE is not a valid locale name',
+                             setup_php_ini_options, options)
+
+    def test_hardens_httpd_tokens(self):
+        with open('defaults/config/httpd/extra/httpd-default.conf') as f:
+            s = f.read()
+            assert 'ServerTokens Prod' in s
+            assert 'ServerSignature Off' in s
+
+    def test_templates_catch_workers_output(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            fpm_file = os.path.join(php_config_dir, version_dir, 'php-fpm.conf')
+            with open(fpm_file) as f:
                 s = f.read()
-                assert 'expose_php = Off' in s
+                assert '\n#{PHP_FPM_CATCH_WORKERS_OUTPUT_CONF}\n' in s
+                assert '\n#{PHP_FPM_DECORATE_WORKERS_OUTPUT_CONF}\n' in s
+
+    def test_error_log(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            options['PHP_FPM_CATCH_WORKERS_OUTPUT'] = False
+            s = self.render_php_ini(version_dir, options)
+            assert '\nerror_log = /dev/stderr\n' in s
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\ncatch_workers_output = yes\n' in s
+            options['PHP_ERROR_LOG'] = '@{HOME}/logs/php_errors.log'
+            s = self.render_php_ini(version_dir, options)
+            assert '\nerror_log = "@{HOME}/logs/php_errors.log"\n' in s
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\ncatch_workers_output = no\n' in s
+
+    def test_fpm_ping(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\n;ping.path = /ping\n' in s
+            assert '\n;ping.response = pong\n' in s
+            options['PHP_FPM_PING'] = True
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nping.path = /fpm-ping\n' in s
+            assert '\nping.response = pong\n' in s
+            options['PHP_FPM_PING'] = '/health'
+            options['PHP_FPM_PING_RESPONSE'] = 'OK'
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nping.path = /health\n' in s
+            assert '\nping.response = OK\n' in s
+
+    def test_fpm_listen_permissions(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            options['PHP_FPM_LISTEN'] = '127.0.0.1:9000'
+            options['PHP_FPM_LISTEN_OWNER'] = 'vcap'
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\n;listen.owner = nobody\n' in s
+            assert '\n;listen.group = nobody\n' in s
+            assert '\n;listen.mode = 0660\n' in s
+            options['PHP_FPM_LISTEN'] = '/tmp/php-fpm.socket'
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nlisten.owner = vcap\n' in s
+            assert '\n;listen.group = nobody\n' in s
+            assert '\nlisten.mode = 0660\n' in s
+            options['PHP_FPM_LISTEN_GROUP'] = 'www-data'
+            options['PHP_FPM_LISTEN_MODE'] = '0666'
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nlisten.group = www-data\n' in s
+            assert '\nlisten.mode = 0666\n' in s
+
+    def test_fpm_listen_permissions_must_be_valid(self):
+        for key, val in (('PHP_FPM_LISTEN_MODE', '0999'),
+                         ('PHP_FPM_LISTEN_OWNER', 'root; rm')):
+            options = self.load_default_options()
+            options[key] = val
+            assert_raises_regexp(RuntimeError, '%s must be a valid' % key,
+                                 setup_fpm_pool_options, options)
+
+    def test_request_terminate_timeout(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\n;request_terminate_timeout = 0\n' in s
+            options['PHP_FPM_REQUEST_TERMINATE_TIMEOUT'] = 60
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nrequest_terminate_timeout = 60\n' in s
+
+    def test_limit_extensions(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\n;security.limit_extensions = .php .php3 .php4 .php5\n' in s
+            options['PHP_FILE_EXTENSIONS'] = ['.php', '.phtml']
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nsecurity.limit_extensions = .php .phtml\n' in s
+
+    def test_php_file_extensions_must_be_extensions(self):
+        options = self.load_default_options()
+        options['PHP_FILE_EXTENSIONS'] = ['.php', '*']
+        assert_raises_regexp(RuntimeError,
+                             'PHP_FILE_EXTENSIONS must be file extensions',
+                             setup_fpm_pool_options, options)
+
+    def test_max_requests(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\npm.max_requests = 500\n' in s
+            options['PHP_FPM_MAX_REQUESTS'] = '0'
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\npm.max_requests = 0\n' in s
+
+    def test_php_admin_values(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nphp_admin_' not in s
+            options['PHP_ADMIN_VALUES'] = {
+                'open_basedir': '/home/vcap/app:/tmp',
+                'allow_url_fopen': False,
+                'bad key': 'x'
+            }
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert s.endswith('\nphp_admin_flag[allow_url_fopen] = off\n'
+                              'php_admin_value[open_basedir] = '
+                              '/home/vcap/app:/tmp\n'), s[-200:]
+            assert 'bad key' not in s
+
+    def test_php_admin_secure_defaults(self):
+        options = self.load_default_options()
+        options['PHP_VERSION'] = '7.2.0'
+        options['PHP_ADMIN_SECURE_DEFAULTS'] = True
+        s = self.render_php_fpm_conf('7.2.x', options)
+        assert ('\nphp_admin_value[disable_functions] = exec,passthru,'
+                'shell_exec,system,proc_open,popen,pcntl_exec\n') in s
+        options['PHP_ADMIN_VALUES'] = {'disable_functions': 'exec'}
+        s = self.render_php_fpm_conf('7.2.x', options)
+        assert '\nphp_admin_value[disable_functions] = exec\n' in s
+
+    def test_clear_env_disabled_by_default(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nclear_env = no\n' in s
+            assert '\nenv[PATH] = $PATH\n' in s
+            assert '\nenv[VCAP_SERVICES] = $VCAP_SERVICES\n' in s
+
+    def test_listen_backlog(self):
+        php_config_dir = 'defaults/config/php'
+        for version_dir in os.listdir(php_config_dir):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '%s.0' % version_dir[:-2]
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nlisten.backlog = -1\n' in s
+            options['PHP_FPM_LISTEN_BACKLOG'] = 4096
+            s = self.render_php_fpm_conf(version_dir, options)
+            assert '\nlisten.backlog = 4096\n' in s
+
+    def test_listen_backlog_must_be_positive(self):
+        for val in (0, -2, 'many'):
+            options = self.load_default_options()
+            options['PHP_VERSION'] = '7.2.3'
+            options['PHP_FPM_LISTEN_BACKLOG'] = val
+            assert_raises_regexp(RuntimeError,
+                                 'PHP_FPM_LISTEN_BACKLOG must be a positive',
+                                 setup_fpm_pool_options, options)
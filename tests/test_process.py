@@ -0,0 +1,128 @@
+# Licensed to the Apache Software Foundation (ASF) under one or more
+# contributor license agreements.  See the NOTICE file distributed with
+# this work for additional information regarding copyright ownership.
+# The ASF licenses this file to You under the Apache License, Version 2.0
+# (the "License"); you may not use this file except in compliance with
+# the License.  You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+import os
+import time
+import signal
+import tempfile
+from dingus import Dingus
+from nose.tools import eq_
+from common.dingus_extension import patches
+from build_pack_utils import process
+
+
+class StubProcess(object):
+    pid = 1234
+
+    def __init__(self, stop_signal=signal.SIGTERM):
+        self.signals = []
+        self.stop_signal = stop_signal
+
+    def running(self):
+        return True
+
+    def signal_group(self, signum):
+        self.signals.append({signal.SIGTERM: 'TERM',
+                             signal.SIGQUIT: 'QUIT',
+                             signal.SIGWINCH: 'WINCH',
+                             signal.SIGKILL: 'KILL'}[signum])
+
+
+class TestProcessManager(object):
+
+    def _manager(self, stop_signal=signal.SIGTERM, **kwargs):
+        pm = process.ProcessManager(**kwargs)
+        self.proc = StubProcess(stop_signal)
+        pm.processes.append(self.proc)
+        return pm
+
+    def test_terminate_waits_for_drain_timeout(self):
+        alarm = Dingus()
+        with patches({
+            'build_pack_utils.process.signal.alarm': alarm,
+            'build_pack_utils.process.signal.signal': Dingus()
+        }):
+            self._manager(drain_timeout=30).terminate()
+        eq_(['TERM'], self.proc.signals)
+        eq_(30, alarm.calls()[0].args[0])
+
+    def test_terminate_without_drain_timeout_kills(self):
+        alarm = Dingus()
+        with patches({
+            'build_pack_utils.process.signal.alarm': alarm,
+            'build_pack_utils.process.signal.signal': Dingus()
+        }):
+            self._manager(drain_timeout=0).terminate()
+        eq_(0, len(alarm.calls()))
+        eq_(['TERM', 'KILL'], self.proc.signals)
+
+    def test_sigterm_drains_with_configured_timeout(self):
+        alarm = Dingus()
+        with patches({
+            'build_pack_utils.process.signal.alarm': alarm,
+            'build_pack_utils.process.signal.signal': Dingus()
+        }):
+            pm = self._manager(drain_timeout=20)
+            pm._on_sigterm(signal.SIGTERM, None)
+        eq_(143, pm.returncode)
+        eq_(20, alarm.calls()[0].args[0])
+
+    def test_terminate_sends_graceful_stop_signal(self):
+        alarm = Dingus()
+        with patches({
+            'build_pack_utils.process.signal.alarm': alarm,
+            'build_pack_utils.process.signal.signal': Dingus()
+        }):
+            self._manager(stop_signal=signal.SIGQUIT,
+                          drain_timeout=30).terminate()
+        eq_(['QUIT'], self.proc.signals)
+        eq_(30, alarm.calls()[0].args[0])
+
+    def test_terminate_graceful_then_kills_without_drain_timeout(self):
+        with patches({
+            'build_pack_utils.process.signal.alarm': Dingus(),
+            'build_pack_utils.process.signal.signal': Dingus()
+        }):
+            self._manager(stop_signal=signal.SIGWINCH,
+                          drain_timeout=0).terminate()
+        eq_(['WINCH', 'KILL'], self.proc.signals)
+
+    def test_terminate_signals_children_of_the_shell(self):
+        # the trap is in a child of the `sh -c` running the command, and
+        #  only hears the signal when the whole group gets it
+        stopped = tempfile.mktemp()
+        cmd = ("sh -c 'trap \"touch %s; exit 0\" QUIT; echo ready; "
+               "while :; do sleep 0.1; done'; echo done" % stopped)
+        pm = process.ProcessManager(drain_timeout=0)
+        pm.add_process('child', cmd, stop_signal=signal.SIGQUIT)
+        proc = pm.processes[0]
+        try:
+            eq_('ready\n', proc.stdout.readline())
+            with patches({
+                'build_pack_utils.process.signal.alarm': Dingus(),
+                'build_pack_utils.process.signal.signal': Dingus()
+            }):
+                pm.drain_timeout = 30
+                pm.terminate()
+            proc.wait()
+            for i in range(50):
+                if not proc.group_running():
+                    break
+                time.sleep(0.1)
+            eq_(False, proc.group_running())
+            eq_(True, os.path.exists(stopped))
+        finally:
+            proc.signal_group(signal.SIGKILL)
+            if os.path.exists(stopped):
+                os.remove(stopped)
@@ -110,6 +110,41 @@ class TestRewriteScriptWithHttpd(BaseRewriteScript):
                     eq_(-1, fin.read().find('@{'))
 
 
+class TestRewriteScriptWithEnvironment(BaseRewriteScript):
+    def __init__(self):
+        BaseRewriteScript.__init__(self)
+
+    def setUp(self):
+        BaseRewriteScript.setUp(self)
+        self.env['MY_VAR'] = 'my-value'
+        self.env['TEMPLATE_ENV'] = 'LISTED_VAR'
+        self.env.pop('UNSET_VAR', None)
+        self.env.pop('LISTED_VAR', None)
+        os.makedirs(self.cfg_dir)
+        with open(os.path.join(self.cfg_dir, 'app.conf'), 'wt') as fout:
+            fout.write('value = @{MY_VAR}\nother = @{UNSET_VAR}\n'
+                       'listed = @{LISTED_VAR}\ntmp = @{TMPDIR}\n')
+
+    def tearDown(self):
+        BaseRewriteScript.tearDown(self)
+
+    def test_rewrite_env_placeholders(self):
+        res = self.run.check_output("%s %s" % (self.rewrite, self.cfg_dir),
+                                    env=self.env,
+                                    cwd=self.run_dir,
+                                    stderr=subprocess.STDOUT,
+                                    shell=True)
+        eq_('', res)
+        with open(os.path.join(self.cfg_dir, 'app.conf')) as fin:
+            eq_('value = my-value\nother = @{UNSET_VAR}\n'
+                'listed = \ntmp = %s\n' % self.env['TMPDIR'],
+                fin.read())
+        with open(os.path.join(self.run_dir, 'logs', 'rewrite.log')) as fin:
+            log = fin.read()
+        assert '[UNSET_VAR] is not set' in log, log
+        assert '[LISTED_VAR] is not set' not in log, log
+
+
 class TestRewriteScriptWithNginx(BaseRewriteScript):
     def __init__(self):
         BaseRewriteScript.__init__(self)